@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/oppewala/plex-local-dl/pkg/plex"
@@ -17,10 +19,30 @@ type apiPostResponse struct {
 	Message string
 }
 
-func getLibraries(w http.ResponseWriter, _ *http.Request) {
-	l, err := plexServer.GetLibraries()
+// apiQueueResponse tells how many parts were queued, so clients can tell when every part was already in the queue
+type apiQueueResponse struct {
+	Message string
+	Queued  int
+}
+
+// DownloadOptions are the per request settings accepted when queuing downloads
+type DownloadOptions struct {
+	Force      bool
+	MediaID    int
+	MediaIndex *int
+	Quality    plex.QualityRules
+	Transcode  *TranscodeProfile
+}
+
+type queuePatchRequest struct {
+	Priority *int
+	Position *int
+}
+
+func getLibraries(w http.ResponseWriter, r *http.Request) {
+	l, err := plexServer.GetLibraries(r.Context())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), plexErrorStatus(err))
 		return
 	}
 
@@ -31,9 +53,9 @@ func getLibraries(w http.ResponseWriter, _ *http.Request) {
 func getLibraryContent(w http.ResponseWriter, r *http.Request) {
 	k := mux.Vars(r)["key"]
 
-	c, err := plexServer.GetLibraryContent(k)
+	c, err := plexServer.GetLibraryContent(r.Context(), k)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), plexErrorStatus(err))
 		return
 	}
 
@@ -44,9 +66,9 @@ func getLibraryContent(w http.ResponseWriter, r *http.Request) {
 func getMediaMetadata(w http.ResponseWriter, r *http.Request) {
 	k := mux.Vars(r)["key"]
 
-	v, err := plexServer.GetMediaMetadata(k)
+	v, err := plexServer.GetMediaMetadata(r.Context(), k)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), plexErrorStatus(err))
 		return
 	}
 
@@ -57,36 +79,120 @@ func getMediaMetadata(w http.ResponseWriter, r *http.Request) {
 func postQueue(w http.ResponseWriter, r *http.Request) {
 	k := mux.Vars(r)["key"]
 
-	meta, err := plexServer.GetMetadataWithParts(k)
+	meta, err := plexServer.GetMetadataWithParts(r.Context(), k)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), plexErrorStatus(err))
 		return
 	}
 
-	for _, m := range meta {
-		log.Printf("[API] Queuing download of media (%s - %s)", k, m.ConcatTitles())
+	opts, err := downloadOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		queueDownload(m)
+	log.Printf("[API] Queuing download of %v items (%s)", len(meta), k)
+	queued, err := queueDownloads(meta, opts)
+	if errors.Is(err, ErrMediaNotFound) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	j, _ := json.Marshal(apiPostResponse{Message: "Download queued"})
+	res := apiQueueResponse{Message: "Download queued", Queued: queued}
+	if queued == 0 {
+		res.Message = "Nothing queued, every part is already in the queue"
+	}
+	j, _ := json.Marshal(res)
 	_, _ = w.Write(j)
 }
 
-func queueDownload(m plex.Metadata) {
-	hub.broadcast <- &DownloadUpdate{
-		MessageType:     "download-start",
-		Title:           m.ConcatTitles(),
-		BytesDownloaded: 0,
-		TotalBytes:      0,
+// downloadOptions reads the options of a download request from its query string
+func downloadOptions(r *http.Request) (DownloadOptions, error) {
+	q := r.URL.Query()
+	quality, err := parseQuality(q.Get)
+	if err != nil {
+		return DownloadOptions{}, err
+	}
+
+	transcode, err := parseTranscodeProfile(q.Get("transcode"), q.Get("transcodeBitrate"))
+	if err != nil {
+		return DownloadOptions{}, err
+	}
+
+	opts := DownloadOptions{
+		Force:     q.Get("force") == "true",
+		Quality:   quality,
+		Transcode: transcode,
+	}
+
+	if v := q.Get("media"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid media id '%v'", v)
+		}
+		opts.MediaID = id
+	}
+	if v := q.Get("mediaIndex"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid media index '%v'", v)
+		}
+		opts.MediaIndex = &i
+	}
+
+	return opts, nil
+}
+
+// queueDownloads queues every part of the selected media of each item with the same enqueue time, so they are
+// downloaded in season, episode and part order. It returns how many parts were added, parts that are already in the
+// queue are skipped
+func queueDownloads(meta []plex.Metadata, opts DownloadOptions) (int, error) {
+	t := time.Now()
+	requests := make([]DownloadRequest, 0, len(meta))
+	for _, m := range meta {
+		media, err := selectMedia(m, opts)
+		if err != nil {
+			return 0, err
+		}
+
+		log.Printf("[API] Queuing download of media (%s - %s) version %v with %v parts", m.RatingKey, m.ConcatTitles(), media.ID, len(media.Part))
+		for i, p := range media.Part {
+			requests = append(requests, DownloadRequest{
+				EnqueuedAt: t,
+				Force:      opts.Force,
+				MediaID:    media.ID,
+				PartIndex:  i,
+				PartCount:  len(media.Part),
+				Transcode:  opts.Transcode,
+				Metadata:   m,
+				Part:       p,
+			})
+		}
 	}
 
-	go func(m plex.Metadata) {
-		requestQueue <- DownloadRequest{
-			Metadata: m,
-			Part:     m.Media[0].Part[0],
+	added, err := downloadQueue.Push(requests...)
+	if err != nil {
+		err = fmt.Errorf("failed to queue %v downloads: %w", len(requests), err)
+		return len(added), err
+	}
+
+	for _, r := range added {
+		hub.broadcast <- &DownloadUpdate{
+			MessageType:     "download-start",
+			ID:              r.ID,
+			RatingKey:       r.Metadata.RatingKey,
+			Title:           r.Title(),
+			BytesDownloaded: 0,
+			TotalBytes:      expectedSize(r),
+			QueuePosition:   downloadQueue.Position(r.ID),
 		}
-	}(m)
+	}
+
+	return len(added), nil
 }
 
 func getSearch(w http.ResponseWriter, r *http.Request) {
@@ -100,10 +206,10 @@ func getSearch(w http.ResponseWriter, r *http.Request) {
 func getMediaParts(w http.ResponseWriter, r *http.Request) {
 	sk := mux.Vars(r)["key"]
 
-	p, err := plexServer.GetMetadataWithParts(sk)
+	p, err := plexServer.GetMetadataWithParts(r.Context(), sk)
 	if err != nil {
 		log.Printf("[API] Error: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), plexErrorStatus(err))
 		return
 	}
 
@@ -114,9 +220,9 @@ func getMediaParts(w http.ResponseWriter, r *http.Request) {
 func postPersist(w http.ResponseWriter, r *http.Request) {
 	k := mux.Vars(r)["key"]
 
-	m, err := plexServer.GetMediaMetadata(k)
+	m, err := plexServer.GetMediaMetadata(r.Context(), k)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), plexErrorStatus(err))
 		return
 	}
 
@@ -126,14 +232,33 @@ func postPersist(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	quality, err := parseQuality(r.URL.Query().Get)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	plexId, _ := strconv.ParseUint(k, 10, 64)
 	err = store.Add(storage.Entry{
 		Category: m.Type,
 		Title:    m.Title,
 		DBId:     tvdbid,
 		PlexKey:  uint(plexId),
+		Quality:  quality,
 	})
 	var dupErr *storage.DuplicateEntryError
+	if err != nil && errors.As(err, &dupErr) && !quality.IsZero() {
+		err = store.SetQuality(m.Type, tvdbid, quality)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("[API] Updated quality rules of tracked entry %v (%v): %+v", m.Title, m.Type, quality)
+		j, _ := json.Marshal(apiPostResponse{Message: "Entry already being tracked, quality rules updated"})
+		_, _ = w.Write(j)
+		return
+	}
 	if err != nil && errors.As(err, &dupErr) {
 		log.Printf("[API] Entry already being tracked: %v", dupErr)
 		j, _ := json.Marshal(apiPostResponse{Message: "Entry already being tracked"})
@@ -153,9 +278,9 @@ func postPersist(w http.ResponseWriter, r *http.Request) {
 func deletePersist(w http.ResponseWriter, r *http.Request) {
 	k := mux.Vars(r)["key"]
 
-	m, err := plexServer.GetMediaMetadata(k)
+	m, err := plexServer.GetMediaMetadata(r.Context(), k)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), plexErrorStatus(err))
 		return
 	}
 
@@ -196,3 +321,130 @@ func deletePersistForce(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func getQueue(w http.ResponseWriter, _ *http.Request) {
+	j, _ := json.Marshal(downloadQueue.List())
+	_, _ = w.Write(j)
+}
+
+func deleteQueue(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := handleCommand(ClientCommand{Command: "cancel", ID: id})
+	if err != nil {
+		http.Error(w, err.Error(), queueErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func patchQueue(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var p queuePatchRequest
+	err := json.NewDecoder(r.Body).Decode(&p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dr, err := downloadQueue.Reorder(id, p.Priority, p.Position)
+	if err != nil {
+		http.Error(w, err.Error(), queueErrorStatus(err))
+		return
+	}
+
+	j, _ := json.Marshal(dr)
+	_, _ = w.Write(j)
+}
+
+func postQueueBump(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	dr, err := downloadQueue.Bump(id)
+	if err != nil {
+		http.Error(w, err.Error(), queueErrorStatus(err))
+		return
+	}
+
+	j, _ := json.Marshal(dr)
+	_, _ = w.Write(j)
+}
+
+func queueErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrRequestNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidState):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// plexErrorStatus maps a failed call to the remote plex server to the status returned to the client
+func plexErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, plex.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, plex.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, plex.ErrUnauthorized), errors.Is(err, plex.ErrUnexpectedStatus):
+		// The token is ours rather than the client's, so this is a problem with the upstream server
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func getBandwidth(w http.ResponseWriter, _ *http.Request) {
+	j, _ := json.Marshal(BandwidthStatus{
+		BandwidthSchedule: bandwidth.Schedule(),
+		Current:           bandwidth.Current(time.Now()),
+	})
+	_, _ = w.Write(j)
+}
+
+func putBandwidth(w http.ResponseWriter, r *http.Request) {
+	var s BandwidthSchedule
+	err := json.NewDecoder(r.Body).Decode(&s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = bandwidth.SetSchedule(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[API] Bandwidth schedule updated: %+v", s)
+	getBandwidth(w, r)
+}
+
+func getHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	from, err := parseHistoryTime(q.Get("from"), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseHistoryTime(q.Get("to"), true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	j, _ := json.Marshal(history.Query(HistoryFilter{
+		From:   from,
+		To:     to,
+		Type:   q.Get("type"),
+		Status: q.Get("status"),
+	}))
+	_, _ = w.Write(j)
+}
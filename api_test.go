@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/oppewala/plex-local-dl/pkg/plex"
+)
+
+func TestPlexErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"not found", plex.NewStatusError("/a", http.StatusNotFound), http.StatusNotFound},
+		{"wrapped not found", fmt.Errorf("failed to get root metadata: %w", plex.NewStatusError("/a", http.StatusNotFound)), http.StatusNotFound},
+		{"timeout", plex.NewRequestError("/a", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{"unavailable", plex.NewStatusError("/a", http.StatusServiceUnavailable), http.StatusServiceUnavailable},
+		{"unauthorized", plex.NewStatusError("/a", http.StatusUnauthorized), http.StatusBadGateway},
+		{"unexpected status", plex.NewStatusError("/a", http.StatusTeapot), http.StatusBadGateway},
+		{"other", errors.New("failed to convert body from json"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := plexErrorStatus(tt.err); got != tt.want {
+				t.Errorf("plexErrorStatus(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueDownloadsCountsAdded(t *testing.T) {
+	defer func(q *DownloadQueue, h *Hub) { downloadQueue, hub = q, h }(downloadQueue, hub)
+	downloadQueue = testQueue(t)
+	hub = &Hub{broadcast: make(chan Message, 10)}
+
+	episode := func(index int, parts ...string) plex.Metadata {
+		media := plex.Media{ID: index}
+		for _, key := range parts {
+			media.Part = append(media.Part, plex.Part{Key: key, File: "/tv/Show/" + key + ".mkv"})
+		}
+		return plex.Metadata{Type: "episode", ParentIndex: 1, Index: index, Media: []plex.Media{media}}
+	}
+
+	queued, err := queueDownloads([]plex.Metadata{episode(1, "e1p0", "e1p1")}, DownloadOptions{})
+	if err != nil || queued != 2 {
+		t.Fatalf("queueDownloads() = %v, %v, want 2 parts queued", queued, err)
+	}
+
+	queued, err = queueDownloads([]plex.Metadata{episode(1, "e1p0", "e1p1"), episode(2, "e2p0")}, DownloadOptions{})
+	if err != nil || queued != 1 {
+		t.Errorf("queueDownloads() = %v, %v, want only the new part queued", queued, err)
+	}
+
+	queued, err = queueDownloads([]plex.Metadata{episode(2, "e2p0")}, DownloadOptions{})
+	if err != nil || queued != 0 {
+		t.Errorf("queueDownloads() = %v, %v, want nothing queued", queued, err)
+	}
+	if got := len(hub.broadcast); got != 3 {
+		t.Errorf("%v download-start messages, want 3", got)
+	}
+}
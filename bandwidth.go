@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BandwidthWindow overrides the default limit between Start and End (24 hour "15:04" local time). Windows where
+// End is before Start wrap around midnight.
+type BandwidthWindow struct {
+	Start string
+	End   string
+	Limit uint64
+}
+
+// BandwidthSchedule is the download speed in bytes per second shared by all workers, a limit of 0 is unlimited
+type BandwidthSchedule struct {
+	Default uint64
+	Windows []BandwidthWindow
+}
+
+type BandwidthStatus struct {
+	BandwidthSchedule
+	Current uint64
+}
+
+// Limiter is a token bucket holding up to one second worth of transfer at the currently scheduled rate
+type Limiter struct {
+	mu       sync.Mutex
+	schedule BandwidthSchedule
+	tokens   float64
+	last     time.Time
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *Limiter
+}
+
+// limitChunk keeps individual reads small so the limiter can spread them out evenly
+const limitChunk = 32 * 1024
+
+func newLimiter(s BandwidthSchedule) *Limiter {
+	return &Limiter{schedule: s, last: time.Now()}
+}
+
+func (l *Limiter) Schedule() BandwidthSchedule {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.schedule
+}
+
+func (l *Limiter) SetSchedule(s BandwidthSchedule) error {
+	for _, w := range s.Windows {
+		if _, err := parseClock(w.Start); err != nil {
+			return err
+		}
+		if _, err := parseClock(w.End); err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.schedule = s
+	l.tokens = 0
+	return nil
+}
+
+// Current returns the limit that applies at t
+func (l *Limiter) Current(t time.Time) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.current(t)
+}
+
+func (l *Limiter) current(t time.Time) uint64 {
+	m := t.Hour()*60 + t.Minute()
+	for _, w := range l.schedule.Windows {
+		start, _ := parseClock(w.Start)
+		end, _ := parseClock(w.End)
+
+		if (start <= end && m >= start && m < end) || (start > end && (m >= start || m < end)) {
+			return w.Limit
+		}
+	}
+
+	return l.schedule.Default
+}
+
+// Wait blocks until n bytes may be transferred
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	rate := float64(l.current(now))
+	if rate == 0 {
+		l.tokens = 0
+		l.last = now
+		l.mu.Unlock()
+		return nil
+	}
+
+	l.tokens += now.Sub(l.last).Seconds() * rate
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+	l.last = now
+
+	// Going into debt queues concurrent readers behind each other
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if d == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func newLimitedReader(ctx context.Context, r io.Reader, l *Limiter) io.Reader {
+	return &limitedReader{ctx: ctx, r: r, limiter: l}
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > limitChunk {
+		p = p[:limitChunk]
+	}
+
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if werr := lr.limiter.Wait(lr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
+
+// parseBandwidthSchedule reads a schedule such as "01:00-07:00=0,18:00-23:00=512KB", the limit outside of the
+// windows is given separately
+func parseBandwidthSchedule(limit string, windows string) (BandwidthSchedule, error) {
+	s := BandwidthSchedule{Windows: make([]BandwidthWindow, 0)}
+
+	d, err := parseBytes(limit)
+	if err != nil {
+		return s, err
+	}
+	s.Default = d
+
+	for _, w := range strings.Split(windows, ",") {
+		w = strings.TrimSpace(w)
+		if w == "" {
+			continue
+		}
+
+		parts := strings.SplitN(w, "=", 2)
+		times := strings.SplitN(parts[0], "-", 2)
+		if len(parts) != 2 || len(times) != 2 {
+			return s, fmt.Errorf("invalid bandwidth window '%v', expected HH:MM-HH:MM=limit", w)
+		}
+
+		l, err := parseBytes(parts[1])
+		if err != nil {
+			return s, err
+		}
+		bw := BandwidthWindow{Start: strings.TrimSpace(times[0]), End: strings.TrimSpace(times[1]), Limit: l}
+		if _, err := parseClock(bw.Start); err != nil {
+			return s, err
+		}
+		if _, err := parseClock(bw.End); err != nil {
+			return s, err
+		}
+		s.Windows = append(s.Windows, bw)
+	}
+
+	return s, nil
+}
+
+// parseClock returns the minutes since midnight of a "15:04" time
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day '%v', expected HH:MM", v)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseBytes reads sizes such as "2MB" or "512KB" using multiples of 1024, a bare number is in bytes
+func parseBytes(v string) (uint64, error) {
+	v = strings.ToUpper(strings.TrimSpace(v))
+	if v == "" {
+		return 0, nil
+	}
+
+	units := []struct {
+		suffix     string
+		multiplier uint64
+	}{
+		{"TB", 1 << 40},
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+
+	m := uint64(1)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v = strings.TrimSpace(strings.TrimSuffix(v, u.suffix))
+			m = u.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%v'", v)
+	}
+
+	return uint64(n * float64(m)), nil
+}
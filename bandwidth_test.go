@@ -0,0 +1,134 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBandwidthSchedule(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   string
+		windows string
+		want    BandwidthSchedule
+		wantErr bool
+	}{
+		{
+			name:  "unlimited",
+			limit: "", windows: "",
+			want: BandwidthSchedule{Windows: []BandwidthWindow{}},
+		},
+		{
+			name:  "default only",
+			limit: "2MB", windows: "",
+			want: BandwidthSchedule{Default: 2 << 20, Windows: []BandwidthWindow{}},
+		},
+		{
+			name:  "windows",
+			limit: "1MB", windows: "01:00-07:00=0, 18:00-23:00=512KB",
+			want: BandwidthSchedule{Default: 1 << 20, Windows: []BandwidthWindow{
+				{Start: "01:00", End: "07:00", Limit: 0},
+				{Start: "18:00", End: "23:00", Limit: 512 << 10},
+			}},
+		},
+		{
+			name:  "across midnight",
+			limit: "", windows: "22:00-06:00=1.5MB",
+			want: BandwidthSchedule{Windows: []BandwidthWindow{
+				{Start: "22:00", End: "06:00", Limit: 3 << 19},
+			}},
+		},
+		{name: "invalid limit", limit: "fast", wantErr: true},
+		{name: "missing limit", windows: "01:00-07:00", wantErr: true},
+		{name: "missing end", windows: "01:00=1MB", wantErr: true},
+		{name: "invalid time", windows: "25:00-07:00=1MB", wantErr: true},
+		{name: "invalid window limit", windows: "01:00-07:00=lots", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBandwidthSchedule(tt.limit, tt.windows)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseBandwidthSchedule() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseBandwidthSchedule() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimiterCurrent(t *testing.T) {
+	s, err := parseBandwidthSchedule("100", "22:00-06:00=1, 12:00-13:00=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimiter(s)
+
+	tests := []struct {
+		clock string
+		want  uint64
+	}{
+		{"21:59", 100},
+		{"22:00", 1},
+		{"23:59", 1},
+		{"00:00", 1},
+		{"05:59", 1},
+		{"06:00", 100},
+		{"11:59", 100},
+		{"12:00", 2},
+		{"12:59", 2},
+		{"13:00", 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.clock, func(t *testing.T) {
+			c, err := time.Parse("15:04", tt.clock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			at := time.Date(2024, 3, 1, c.Hour(), c.Minute(), 0, 0, time.Local)
+
+			if got := l.Current(at); got != tt.want {
+				t.Errorf("Current(%v) = %v, want %v", tt.clock, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		v       string
+		want    uint64
+		wantErr bool
+	}{
+		{v: "", want: 0},
+		{v: "100", want: 100},
+		{v: "100B", want: 100},
+		{v: "512kb", want: 512 << 10},
+		{v: "2 MB", want: 2 << 20},
+		{v: "1.5GB", want: 3 << 29},
+		{v: "2TB", want: 2 << 40},
+		{v: "-1MB", wantErr: true},
+		{v: "MB", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.v, func(t *testing.T) {
+			got, err := parseBytes(tt.v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBytes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseBytes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// spaceRetryInterval is how long a request waits before free space is checked again
+const spaceRetryInterval = time.Minute * 5
+
+// usageRefreshInterval is how long the size of the media directory is trusted before it is walked again. Downloads
+// add what they write in between, so this only needs to catch changes made outside of the app.
+const usageRefreshInterval = spaceRetryInterval
+
+// InsufficientSpaceError is returned by the preflight check when a download would not fit on disk or in the quota
+type InsufficientSpaceError struct {
+	Required  uint64
+	Available uint64
+	Quota     bool
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	limit := "free space"
+	if e.Quota {
+		limit = "quota"
+	}
+
+	return fmt.Sprintf("download needs %v bytes but only %v bytes of %v remain", e.Required, e.Available, limit)
+}
+
+var (
+	reservedMu sync.Mutex
+	reserved   = make(map[string]uint64)
+
+	// usedSize caches the size of mediaPath for the quota, usedAt is when it was last walked
+	usedSize uint64
+	usedAt   time.Time
+)
+
+// reserveSpace checks there is room for the remaining bytes of the request on top of the space already reserved by
+// running downloads and the space needed by requests ahead of it in the queue, and reserves it until releaseSpace is
+// called. Counting the requests ahead stops a later request from taking the space an earlier one is waiting for.
+// A request larger than the whole quota can never fit and fails for good.
+func reserveSpace(r DownloadRequest, path string) error {
+	remaining := remainingSize(r, path)
+	if storageQuota > 0 && remaining > storageQuota {
+		return &PermanentError{Err: fmt.Errorf("download needs %v bytes, more than the whole quota of %v bytes", remaining, storageQuota)}
+	}
+
+	reservedMu.Lock()
+	defer reservedMu.Unlock()
+
+	var inUse uint64
+	for id, b := range reserved {
+		if id != r.ID {
+			inUse += b
+		}
+	}
+
+	free, err := freeSpace(mediaPath)
+	if err != nil {
+		return fmt.Errorf("failed to check free space of %v: %w", mediaPath, err)
+	}
+	room := subtractOrZero(free, inUse)
+	quota := false
+
+	if storageQuota > 0 {
+		used, err := usedSpace()
+		if err != nil {
+			return fmt.Errorf("failed to calculate size of %v: %w", mediaPath, err)
+		}
+		if q := subtractOrZero(storageQuota, used+inUse); q < room {
+			room = q
+			quota = true
+		}
+	}
+
+	ahead := queuedAheadSize(r.ID, room)
+	if ahead+remaining > room {
+		return &InsufficientSpaceError{Required: remaining, Available: subtractOrZero(room, ahead), Quota: quota}
+	}
+
+	reserved[r.ID] = remaining
+	return nil
+}
+
+// releaseSpace drops the reservation of a download that has stopped, written is the number of bytes it added to disk
+func releaseSpace(id string, written uint64) {
+	reservedMu.Lock()
+	defer reservedMu.Unlock()
+
+	delete(reserved, id)
+	usedSize += written
+}
+
+// remainingSize is the number of bytes the request still has to write to path
+func remainingSize(r DownloadRequest, path string) uint64 {
+	remaining := expectedSize(r)
+	if fi, err := os.Stat(path + ".tmp"); err == nil && uint64(fi.Size()) < remaining {
+		remaining -= uint64(fi.Size())
+	}
+
+	// The temp file of a segmented download is sized up front, its progress tells what has actually been written
+	if b, err := ioutil.ReadFile(segmentsProgressPath(path)); err == nil {
+		var p segmentProgress
+		if json.Unmarshal(b, &p) == nil && p.written() < remaining {
+			remaining -= p.written()
+		}
+	}
+
+	return remaining
+}
+
+// queuedAheadSize is the space needed by the requests that are queued or waiting for space ahead of the request.
+// Requests that wouldn't fit in room on their own are left out, they would otherwise hold up every request behind
+// them until space is freed. So are retries of failed attempts that aren't due yet.
+func queuedAheadSize(id string, room uint64) uint64 {
+	now := time.Now()
+
+	var size uint64
+	for _, o := range downloadQueue.List() {
+		if o.ID == id {
+			break
+		}
+		if o.State == StateQueued && o.NextAttempt.After(now) {
+			continue
+		}
+		if o.State != StateQueued && o.State != StateWaitingForSpace {
+			continue
+		}
+		if s := remainingSize(o, downloadPath(o)); s <= room {
+			size += s
+		}
+	}
+
+	return size
+}
+
+// usedSpace returns the size of mediaPath, walking it again once the cached size is older than usageRefreshInterval.
+// Must be called with reservedMu held.
+func usedSpace() (uint64, error) {
+	if !usedAt.IsZero() && time.Since(usedAt) < usageRefreshInterval {
+		return usedSize, nil
+	}
+
+	size, err := directorySize(mediaPath)
+	if err != nil {
+		return 0, err
+	}
+	usedSize = size
+	usedAt = time.Now()
+
+	return usedSize, nil
+}
+
+// waitForSpace puts the request aside until the next space check is due
+func waitForSpace(r DownloadRequest, spaceErr error) {
+	r, err := downloadQueue.Update(r.ID, func(r *DownloadRequest) error {
+		r.State = StateWaitingForSpace
+		r.NextAttempt = time.Now().Add(spaceRetryInterval)
+		r.LastError = spaceErr.Error()
+		return nil
+	})
+	if err != nil {
+		log.Printf("[Processor] Failed to mark %v (%v) as waiting for space: %v", r.Title(), r.ID, err)
+		return
+	}
+
+	log.Printf("[Processor] Waiting for space for %v until %v: %v", r.Title(), r.NextAttempt.Format(time.RFC3339), spaceErr)
+	broadcastState(r)
+}
+
+func directorySize(root string) (uint64, error) {
+	var size uint64
+	err := filepath.Walk(root, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += uint64(info.Size())
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+func subtractOrZero(a uint64, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+
+	return a - b
+}
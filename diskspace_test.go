@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// testSpace points the space checks at an empty media directory and a fresh queue
+func testSpace(t *testing.T, quota uint64) {
+	dir, err := ioutil.TempDir("", "media")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldQueue, oldMedia, oldQuota := downloadQueue, mediaPath, storageQuota
+	t.Cleanup(func() {
+		downloadQueue, mediaPath, storageQuota = oldQueue, oldMedia, oldQuota
+		usedAt = time.Time{}
+		_ = os.RemoveAll(dir)
+	})
+
+	downloadQueue = testQueue(t)
+	mediaPath = dir
+	storageQuota = quota
+	usedAt = time.Time{}
+}
+
+func pushSized(t *testing.T, episode int, size uint64, state string) DownloadRequest {
+	r := testEpisode(1, episode, 0)
+	r.Part.Size = size
+
+	added, err := downloadQueue.Push(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = downloadQueue.Transition(added[0].ID, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestQueuedAheadSize(t *testing.T) {
+	testSpace(t, 0)
+
+	pushSized(t, 1, 5000, StateWaitingForSpace)
+	pushSized(t, 2, 300, StateWaitingForSpace)
+	pushSized(t, 3, 200, StateQueued)
+	backoff := pushSized(t, 4, 100, StateQueued)
+	_, err := downloadQueue.Update(backoff.ID, func(r *DownloadRequest) error {
+		r.NextAttempt = time.Now().Add(time.Hour)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushSized(t, 5, 50, StateDownloading)
+	r := pushSized(t, 6, 10, StateDownloading)
+	pushSized(t, 7, 400, StateQueued)
+
+	// The request that can never fit in 1000 bytes, the one in backoff, the running one and the one behind are left out
+	if got, want := queuedAheadSize(r.ID, 1000), uint64(500); got != want {
+		t.Errorf("queuedAheadSize() = %v, want %v", got, want)
+	}
+	if got, want := queuedAheadSize(r.ID, 250), uint64(200); got != want {
+		t.Errorf("queuedAheadSize() with less room = %v, want %v", got, want)
+	}
+}
+
+func TestReserveSpaceSkipsRequestsThatCannotFit(t *testing.T) {
+	testSpace(t, 1000)
+
+	pushSized(t, 1, 900, StateWaitingForSpace)
+	pushSized(t, 2, 5000, StateWaitingForSpace)
+	small := pushSized(t, 3, 50, StateDownloading)
+	defer releaseSpace(small.ID, 0)
+
+	// The 900 byte request ahead still fits, so only what's left of the quota is available
+	err := reserveSpace(small, downloadPath(small))
+	if err != nil {
+		t.Fatalf("reserveSpace() = %v, want the request to fit next to the one ahead", err)
+	}
+
+	late := pushSized(t, 4, 100, StateDownloading)
+	var spaceErr *InsufficientSpaceError
+	if err := reserveSpace(late, downloadPath(late)); !errors.As(err, &spaceErr) || !spaceErr.Quota {
+		t.Fatalf("reserveSpace() = %v, want the quota to be exceeded", err)
+	}
+}
+
+func TestReserveSpaceLargerThanQuota(t *testing.T) {
+	testSpace(t, 1000)
+
+	r := pushSized(t, 1, 5000, StateDownloading)
+	err := reserveSpace(r, downloadPath(r))
+
+	var pe *PermanentError
+	if !errors.As(err, &pe) {
+		t.Fatalf("reserveSpace() = %v, want a PermanentError", err)
+	}
+	if isRetryable(err) {
+		t.Error("isRetryable() = true for a request larger than the quota")
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// freeSpace returns the bytes available to unprivileged users on the filesystem holding path
+func freeSpace(path string) (uint64, error) {
+	var s syscall.Statfs_t
+	err := syscall.Statfs(path, &s)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(s.Bavail) * uint64(s.Bsize), nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type ClientCommand struct {
+	Command string
+	ID      string
+}
+
+type DownloadState struct {
+	MessageType string
+	ID          string
+	Title       string
+	State       string
+	Attempts    int
+	NextAttempt time.Time
+	Error       string
+}
+
+func (u *DownloadState) ToBytes() []byte {
+	j, _ := json.Marshal(u)
+
+	return j
+}
+
+// activeDownload lets a command stop a running download, reason is the state the request moves to once it has stopped
+type activeDownload struct {
+	cancel context.CancelFunc
+	reason string
+}
+
+var (
+	activeMu sync.Mutex
+	active   = make(map[string]*activeDownload)
+)
+
+// startActive registers a download that is about to run, returning false if a command has already moved it out of
+// the downloading state
+func startActive(id string, cancel context.CancelFunc) bool {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	r, ok := downloadQueue.Get(id)
+	if !ok || r.State != StateDownloading {
+		return false
+	}
+
+	active[id] = &activeDownload{cancel: cancel}
+	return true
+}
+
+// stopActive removes a finished download and returns the state requested by a command, if any
+func stopActive(id string) string {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	a, ok := active[id]
+	if !ok {
+		return ""
+	}
+	delete(active, id)
+
+	return a.reason
+}
+
+func handleCommand(c ClientCommand) error {
+	log.Printf("[Processor] Command received: %v %v", c.Command, c.ID)
+
+	switch c.Command {
+	case "cancel":
+		return stopDownload(c.ID, StateCancelled, StateQueued, StateWaitingForSpace, StateDownloading, StatePaused, StateFailed)
+	case "pause":
+		return stopDownload(c.ID, StatePaused, StateQueued, StateWaitingForSpace, StateDownloading)
+	case "resume":
+		return requeueDownload(c.ID, StatePaused)
+	case "retry":
+		return requeueDownload(c.ID, StateFailed)
+	case "bump":
+		_, err := downloadQueue.Bump(c.ID)
+		return err
+	default:
+		return fmt.Errorf("unknown command '%v'", c.Command)
+	}
+}
+
+func stopDownload(id string, state string, from ...string) error {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	if a, ok := active[id]; ok {
+		// The worker moves the request into the new state once the copy has stopped
+		a.reason = state
+		a.cancel()
+		return nil
+	}
+
+	r, err := downloadQueue.Transition(id, state, from...)
+	if err != nil {
+		return err
+	}
+	if state == StateCancelled {
+		removeTemp(r)
+		history.Record(r, StateCancelled, nil, nil)
+	}
+	broadcastState(r)
+
+	return nil
+}
+
+// checkpointActive stops every running download and puts it back in the queue, keeping the temp file so it resumes
+// from where it stopped after a restart. Segmented downloads resume each segment from its saved progress.
+func checkpointActive() int {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	n := 0
+	for _, a := range active {
+		// Leave downloads that are already being paused or cancelled alone
+		if a.reason != "" {
+			continue
+		}
+		a.reason = StateQueued
+		a.cancel()
+		n++
+	}
+
+	return n
+}
+
+func requeueDownload(id string, from ...string) error {
+	r, err := downloadQueue.Update(id, func(r *DownloadRequest) error {
+		if !containsState(from, r.State) {
+			return fmt.Errorf("%w: %v is %v, expected one of %v", ErrInvalidState, id, r.State, from)
+		}
+		// Another request for the same file may have been queued while this one was paused or failed
+		if d := downloadQueue.duplicate(r); d != nil {
+			return fmt.Errorf("%w: %v writes to the same file as %v", ErrInvalidState, id, d.ID)
+		}
+
+		// A manual retry starts the attempt count and backoff over
+		r.State = StateQueued
+		r.Attempts = 0
+		r.NextAttempt = time.Time{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	broadcastState(r)
+
+	return nil
+}
+
+func removeTemp(r DownloadRequest) {
+	path := downloadPath(r)
+	for _, tmp := range []string{path + ".tmp", segmentsTempPath(path), segmentsProgressPath(path)} {
+		err := os.Remove(tmp)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("[Processor] Failed to remove temp file for %v: %v", r.Title(), err)
+		}
+	}
+}
+
+func broadcastState(r DownloadRequest) {
+	hub.broadcast <- &DownloadState{
+		MessageType: "download-state",
+		ID:          r.ID,
+		Title:       r.Title(),
+		State:       r.State,
+		Attempts:    r.Attempts,
+		NextAttempt: r.NextAttempt,
+		Error:       r.LastError,
+	}
+}
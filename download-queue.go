@@ -0,0 +1,469 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	StateQueued          = "queued"
+	StateWaitingForSpace = "waiting-for-space"
+	StateDownloading     = "downloading"
+	StatePaused          = "paused"
+	StateFailed          = "failed"
+	StateCancelled       = "cancelled"
+	StateDone            = "done"
+)
+
+var (
+	ErrRequestNotFound = errors.New("download request not found")
+	ErrInvalidState    = errors.New("download request is in the wrong state")
+)
+
+// DownloadQueue holds every unfinished download request along with its state and mirrors it to a json file, so
+// pending downloads can be picked up again after a restart. Requests are dropped once they are done or cancelled,
+// the history keeps track of them from then on. Queued requests are kept in priority order: highest priority
+// first, then oldest enqueue time, then season, episode and part index so a show downloads in order.
+type DownloadQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	path   string
+	items  []*DownloadRequest
+	closed bool
+	// wake is shared by the workers waiting in Next to wake up once the earliest retry is due at wakeAt
+	wake   *time.Timer
+	wakeAt time.Time
+}
+
+func loadDownloadQueue(path string) (*DownloadQueue, error) {
+	q := &DownloadQueue{
+		path:  path,
+		items: make([]*DownloadRequest, 0),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Printf("[Queue] No queue found at %v, starting empty", path)
+		return q, nil
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to read queue file %v: %w", path, err)
+		return nil, err
+	}
+
+	var items []*DownloadRequest
+	err = json.Unmarshal(b, &items)
+	if err != nil {
+		err = fmt.Errorf("failed to convert queue file %v from json: %w", path, err)
+		return nil, err
+	}
+
+	for _, r := range items {
+		switch r.State {
+		case StateDone, StateCancelled:
+			continue
+		case StateDownloading:
+			// Interrupted by the restart, the temp file is resumed when it's picked up again
+			r.State = StateQueued
+		}
+		q.items = append(q.items, r)
+	}
+	log.Printf("[Queue] Restored %v requests from %v", len(q.items), path)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q, q.save()
+}
+
+// Push adds requests to the queue in priority order, saves it once and wakes up the waiting workers. Requests queued
+// together should share an EnqueuedAt so they are ordered by season and episode. A request for a part or destination
+// that is already queued, downloading, paused or failed is skipped, only the requests that were added are returned.
+func (q *DownloadQueue) Push(rs ...DownloadRequest) ([]DownloadRequest, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	added := make([]DownloadRequest, 0, len(rs))
+	for _, r := range rs {
+		if d := q.duplicate(&r); d != nil {
+			log.Printf("[Queue] Skipping %v, already in the queue as %v (%v)", r.Title(), d.ID, d.State)
+			continue
+		}
+
+		r := r
+		r.ID = newRequestID()
+		r.State = StateQueued
+		if r.EnqueuedAt.IsZero() {
+			r.EnqueuedAt = time.Now()
+		}
+		q.insert(&r)
+		added = append(added, r)
+	}
+	if len(added) == 0 {
+		return added, nil
+	}
+
+	err := q.save()
+	if err != nil {
+		return added, err
+	}
+
+	q.cond.Broadcast()
+	return added, nil
+}
+
+// Next blocks until a queued request, or one waiting for space, is due and marks it as downloading. It returns false
+// once the queue has been closed.
+func (q *DownloadQueue) Next() (DownloadRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.closed {
+			return DownloadRequest{}, false
+		}
+
+		now := time.Now()
+		var wake time.Time
+		for _, r := range q.items {
+			if r.State != StateQueued && r.State != StateWaitingForSpace {
+				continue
+			}
+			if r.NextAttempt.After(now) {
+				if wake.IsZero() || r.NextAttempt.Before(wake) {
+					wake = r.NextAttempt
+				}
+				continue
+			}
+
+			r.State = StateDownloading
+			if err := q.save(); err != nil {
+				log.Printf("[Queue] Failed to save queue: %v", err)
+			}
+			return *r, true
+		}
+
+		// Wake up again once the earliest waiting retry is due
+		if !wake.IsZero() {
+			q.wakeAfter(now, wake)
+		}
+		q.cond.Wait()
+	}
+}
+
+// wakeAfter makes sure the waiting workers are woken up at t, moving the timer forward if it is set for later or has
+// already fired. Must be called with mu held.
+func (q *DownloadQueue) wakeAfter(now time.Time, t time.Time) {
+	if q.wake != nil && q.wakeAt.After(now) && !q.wakeAt.After(t) {
+		return
+	}
+
+	q.wakeAt = t
+	if q.wake == nil {
+		q.wake = time.AfterFunc(t.Sub(now), q.cond.Broadcast)
+		return
+	}
+	q.wake.Reset(t.Sub(now))
+}
+
+// Close stops Next from handing out requests and wakes up the workers waiting on it. Requests can still be pushed
+// and updated, they are picked up after a restart.
+func (q *DownloadQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	if q.wake != nil {
+		q.wake.Stop()
+	}
+	q.cond.Broadcast()
+}
+
+// Flush writes the queue to disk
+func (q *DownloadQueue) Flush() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.save()
+}
+
+// Get returns a copy of the request with the given id
+func (q *DownloadQueue) Get(id string) (DownloadRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r := q.find(id)
+	if r == nil {
+		return DownloadRequest{}, false
+	}
+
+	return *r, true
+}
+
+// Position is the place of the request among those waiting to be downloaded, starting at 1, or 0 when it isn't
+// waiting
+func (q *DownloadQueue) Position(id string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for _, r := range q.items {
+		if r.State != StateQueued && r.State != StateWaitingForSpace {
+			continue
+		}
+		n++
+		if r.ID == id {
+			return n
+		}
+	}
+
+	return 0
+}
+
+// Transition moves the request with the given id into a new state, failing if it is not currently in one of the
+// states in from. Any state is accepted when from is empty.
+func (q *DownloadQueue) Transition(id string, state string, from ...string) (DownloadRequest, error) {
+	return q.Update(id, func(r *DownloadRequest) error {
+		if len(from) > 0 && !containsState(from, r.State) {
+			return fmt.Errorf("%w: %v is %v, expected one of %v", ErrInvalidState, id, r.State, from)
+		}
+		r.State = state
+
+		return nil
+	})
+}
+
+// Update applies fn to the request with the given id and saves the queue, nothing is saved if fn returns an error
+func (q *DownloadQueue) Update(id string, fn func(r *DownloadRequest) error) (DownloadRequest, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r := q.find(id)
+	if r == nil {
+		return DownloadRequest{}, fmt.Errorf("%w: %v", ErrRequestNotFound, id)
+	}
+
+	u := *r
+	err := fn(&u)
+	if err != nil {
+		return *r, err
+	}
+	*r = u
+
+	switch r.State {
+	case StateQueued:
+		q.cond.Broadcast()
+	case StateDone, StateCancelled:
+		q.remove(r)
+	}
+
+	return *r, q.save()
+}
+
+// List returns copies of every request that has not finished downloading, in the order they will be picked up
+func (q *DownloadQueue) List() []DownloadRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l := make([]DownloadRequest, 0, len(q.items))
+	for _, r := range q.items {
+		l = append(l, *r)
+	}
+
+	return l
+}
+
+// Reorder changes the priority of a request and/or moves it to a position in the list returned by List
+func (q *DownloadQueue) Reorder(id string, priority *int, position *int) (DownloadRequest, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r := q.find(id)
+	if r == nil {
+		return DownloadRequest{}, fmt.Errorf("%w: %v", ErrRequestNotFound, id)
+	}
+
+	if priority != nil {
+		r.Priority = *priority
+		q.remove(r)
+		q.insert(r)
+	}
+
+	if position != nil {
+		if *position < 0 || *position >= len(q.items) {
+			return *r, fmt.Errorf("position %v is outside of the queue (0 - %v)", *position, len(q.items)-1)
+		}
+
+		target := q.items[*position]
+		if target != r {
+			// Moving further back places the request behind the target, otherwise it goes in front of it
+			after := q.index(r) < q.index(target)
+			q.remove(r)
+
+			i := q.index(target)
+			if after {
+				i++
+			}
+			q.items = insertAt(q.items, i, r)
+		}
+	}
+
+	return *r, q.save()
+}
+
+// Bump moves a request to the front of the queue, raising its priority above every other queued request
+func (q *DownloadQueue) Bump(id string) (DownloadRequest, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r := q.find(id)
+	if r == nil {
+		return DownloadRequest{}, fmt.Errorf("%w: %v", ErrRequestNotFound, id)
+	}
+
+	for _, o := range q.items {
+		if o != r && o.State == StateQueued && o.Priority >= r.Priority {
+			r.Priority = o.Priority + 1
+		}
+	}
+	q.remove(r)
+	q.items = insertAt(q.items, 0, r)
+
+	return *r, q.save()
+}
+
+// duplicate finds another request that would write to the same file as r. Two workers downloading the same part
+// would both truncate and write the same temp file. Failed requests count as they can be retried. Must be called
+// with mu held, as it is in the fn passed to Update.
+func (q *DownloadQueue) duplicate(r *DownloadRequest) *DownloadRequest {
+	path := downloadPath(*r)
+	for _, o := range q.items {
+		if o.ID == r.ID {
+			continue
+		}
+		if !containsState([]string{StateQueued, StateWaitingForSpace, StateDownloading, StatePaused, StateFailed}, o.State) {
+			continue
+		}
+		if o.Part.Key == r.Part.Key && o.Transcode.equal(r.Transcode) {
+			return o
+		}
+		if downloadPath(*o) == path {
+			return o
+		}
+	}
+
+	return nil
+}
+
+// insert places the request in front of the first queued request it should be downloaded before
+func (q *DownloadQueue) insert(r *DownloadRequest) {
+	for i, o := range q.items {
+		if o.State == StateQueued && queuedBefore(r, o) {
+			q.items = insertAt(q.items, i, r)
+			return
+		}
+	}
+
+	q.items = append(q.items, r)
+}
+
+func (q *DownloadQueue) remove(r *DownloadRequest) {
+	i := q.index(r)
+	if i < 0 {
+		return
+	}
+
+	q.items = append(q.items[:i], q.items[i+1:]...)
+}
+
+func (q *DownloadQueue) index(r *DownloadRequest) int {
+	for i, o := range q.items {
+		if o == r {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func queuedBefore(a *DownloadRequest, b *DownloadRequest) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if !a.EnqueuedAt.Equal(b.EnqueuedAt) {
+		return a.EnqueuedAt.Before(b.EnqueuedAt)
+	}
+	if a.Metadata.ParentIndex != b.Metadata.ParentIndex {
+		return a.Metadata.ParentIndex < b.Metadata.ParentIndex
+	}
+	if a.Metadata.Index != b.Metadata.Index {
+		return a.Metadata.Index < b.Metadata.Index
+	}
+
+	return a.PartIndex < b.PartIndex
+}
+
+func insertAt(items []*DownloadRequest, i int, r *DownloadRequest) []*DownloadRequest {
+	items = append(items, nil)
+	copy(items[i+1:], items[i:])
+	items[i] = r
+
+	return items
+}
+
+func (q *DownloadQueue) find(id string) *DownloadRequest {
+	for _, r := range q.items {
+		if r.ID == id {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// save writes the queue to disk - the caller must hold the lock
+func (q *DownloadQueue) save() error {
+	j, err := json.Marshal(q.items)
+	if err != nil {
+		err = fmt.Errorf("failed to marshal queue: %w", err)
+		return err
+	}
+
+	err = ioutil.WriteFile(q.path+".tmp", j, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(q.path+".tmp", q.path)
+}
+
+func containsState(states []string, state string) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
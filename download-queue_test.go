@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/oppewala/plex-local-dl/pkg/plex"
+)
+
+func testQueue(t *testing.T) *DownloadQueue {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	q, err := loadDownloadQueue(filepath.Join(dir, "queue.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return q
+}
+
+func testEpisode(season int, episode int, part int) DownloadRequest {
+	key := fmt.Sprintf("s%02de%02dp%d", season, episode, part)
+	return DownloadRequest{
+		PartIndex: part,
+		Metadata:  plex.Metadata{Type: "episode", ParentIndex: season, Index: episode},
+		Part:      plex.Part{Key: key, File: "/tv/Show/" + key + ".mkv"},
+	}
+}
+
+func queueKeys(q *DownloadQueue) []string {
+	keys := make([]string, 0)
+	for _, r := range q.List() {
+		keys = append(keys, r.Part.Key)
+	}
+
+	return keys
+}
+
+func TestQueuedBefore(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Minute)
+
+	tests := []struct {
+		name string
+		a    DownloadRequest
+		b    DownloadRequest
+		want bool
+	}{
+		{"higher priority first", DownloadRequest{Priority: 1, EnqueuedAt: later}, DownloadRequest{EnqueuedAt: now}, true},
+		{"lower priority last", DownloadRequest{EnqueuedAt: now}, DownloadRequest{Priority: 1, EnqueuedAt: later}, false},
+		{"older first", DownloadRequest{EnqueuedAt: now}, DownloadRequest{EnqueuedAt: later}, true},
+		{"newer last", DownloadRequest{EnqueuedAt: later}, DownloadRequest{EnqueuedAt: now}, false},
+		{"earlier season first", testEpisode(1, 9, 0), testEpisode(2, 1, 0), true},
+		{"later season last", testEpisode(2, 1, 0), testEpisode(1, 9, 0), false},
+		{"earlier episode first", testEpisode(1, 2, 0), testEpisode(1, 10, 0), true},
+		{"later episode last", testEpisode(1, 10, 0), testEpisode(1, 2, 0), false},
+		{"earlier part first", testEpisode(1, 1, 0), testEpisode(1, 1, 1), true},
+		{"later part last", testEpisode(1, 1, 1), testEpisode(1, 1, 0), false},
+		{"equal", testEpisode(1, 1, 0), testEpisode(1, 1, 0), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queuedBefore(&tt.a, &tt.b); got != tt.want {
+				t.Errorf("queuedBefore() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPushOrdersBySeasonEpisodeAndPart(t *testing.T) {
+	q := testQueue(t)
+
+	now := time.Now()
+	rs := []DownloadRequest{testEpisode(2, 1, 0), testEpisode(1, 2, 1), testEpisode(1, 10, 0), testEpisode(1, 2, 0)}
+	for i := range rs {
+		rs[i].EnqueuedAt = now
+	}
+
+	_, err := q.Push(rs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"s01e02p0", "s01e02p1", "s01e10p0", "s02e01p0"}
+	if got := queueKeys(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+}
+
+func TestReorder(t *testing.T) {
+	tests := []struct {
+		name     string
+		from     int
+		position int
+		want     []string
+	}{
+		{"forward", 3, 1, []string{"s01e01p0", "s01e04p0", "s01e02p0", "s01e03p0"}},
+		{"to front", 2, 0, []string{"s01e03p0", "s01e01p0", "s01e02p0", "s01e04p0"}},
+		{"back", 0, 2, []string{"s01e02p0", "s01e03p0", "s01e01p0", "s01e04p0"}},
+		{"to end", 1, 3, []string{"s01e01p0", "s01e03p0", "s01e04p0", "s01e02p0"}},
+		{"same place", 2, 2, []string{"s01e01p0", "s01e02p0", "s01e03p0", "s01e04p0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := testQueue(t)
+
+			now := time.Now()
+			rs := make([]DownloadRequest, 0)
+			for e := 1; e <= 4; e++ {
+				r := testEpisode(1, e, 0)
+				r.EnqueuedAt = now
+				rs = append(rs, r)
+			}
+			added, err := q.Push(rs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			position := tt.position
+			_, err = q.Reorder(added[tt.from].ID, nil, &position)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := queueKeys(q); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReorderOutsideQueue(t *testing.T) {
+	q := testQueue(t)
+
+	added, err := q.Push(testEpisode(1, 1, 0), testEpisode(1, 2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, position := range []int{-1, 2} {
+		position := position
+		if _, err := q.Reorder(added[0].ID, nil, &position); err == nil {
+			t.Errorf("Reorder() to %v succeeded, want an error", position)
+		}
+	}
+}
+
+func TestBump(t *testing.T) {
+	q := testQueue(t)
+
+	now := time.Now()
+	a, b, c := testEpisode(1, 1, 0), testEpisode(1, 2, 0), testEpisode(1, 3, 0)
+	a.Priority = 2
+	for _, r := range []*DownloadRequest{&a, &b, &c} {
+		r.EnqueuedAt = now
+	}
+
+	added, err := q.Push(a, b, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bumped, err := q.Bump(added[2].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"s01e03p0", "s01e01p0", "s01e02p0"}
+	if got := queueKeys(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+	if bumped.Priority <= a.Priority {
+		t.Errorf("priority = %v, want above %v", bumped.Priority, a.Priority)
+	}
+
+	// A request pushed later with the old highest priority stays behind the bumped one
+	d := testEpisode(1, 4, 0)
+	d.Priority = a.Priority
+	if _, err := q.Push(d); err != nil {
+		t.Fatal(err)
+	}
+	if got := queueKeys(q)[0]; got != "s01e03p0" {
+		t.Errorf("front = %v, want s01e03p0", got)
+	}
+}
+
+func TestBumpUnknown(t *testing.T) {
+	q := testQueue(t)
+
+	_, err := q.Bump("missing")
+	if !errors.Is(err, ErrRequestNotFound) {
+		t.Fatalf("Bump() error = %v, want ErrRequestNotFound", err)
+	}
+}
+
+func TestPushSkipsDuplicates(t *testing.T) {
+	for _, state := range []string{StateQueued, StateWaitingForSpace, StateDownloading, StatePaused, StateFailed} {
+		t.Run(state, func(t *testing.T) {
+			q := testQueue(t)
+
+			added, err := q.Push(testEpisode(1, 1, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := q.Transition(added[0].ID, state); err != nil {
+				t.Fatal(err)
+			}
+
+			// The same part, and another part written to the same file
+			other := testEpisode(1, 1, 0)
+			other.Part.Key = "other"
+			added, err = q.Push(testEpisode(1, 1, 0), other, testEpisode(1, 2, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(added) != 1 || added[0].Part.Key != "s01e02p0" {
+				t.Errorf("Push() added %v, want only s01e02p0", added)
+			}
+		})
+	}
+}
+
+func TestRequeueRefusesDuplicates(t *testing.T) {
+	defer func(q *DownloadQueue) { downloadQueue = q }(downloadQueue)
+	downloadQueue = testQueue(t)
+
+	added, err := downloadQueue.Push(testEpisode(1, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := added[0]
+	if _, err := downloadQueue.Transition(failed.ID, StateFailed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queued before failed requests were counted as duplicates
+	r := testEpisode(1, 1, 0)
+	r.ID = newRequestID()
+	r.State = StateQueued
+	downloadQueue.mu.Lock()
+	downloadQueue.insert(&r)
+	downloadQueue.mu.Unlock()
+
+	err = requeueDownload(failed.ID, StateFailed)
+	if !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("requeueDownload() = %v, want ErrInvalidState", err)
+	}
+	if got, _ := downloadQueue.Get(failed.ID); got.State != StateFailed {
+		t.Errorf("state = %v, want %v", got.State, StateFailed)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/oppewala/plex-local-dl/pkg/plex"
+)
+
+// maxRetryDelay caps the exponential backoff between attempts
+const maxRetryDelay = time.Hour * 6
+
+// PermanentError marks a download failure that will not be fixed by trying again
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func isRetryable(err error) bool {
+	var pe *PermanentError
+	if errors.As(err, &pe) {
+		return false
+	}
+
+	// A bad token or a removed item won't be fixed by waiting, an overloaded or unreachable server might be
+	var plexErr *plex.Error
+	if errors.As(err, &plexErr) {
+		return errors.Is(err, plex.ErrUnavailable)
+	}
+
+	if errors.Is(err, syscall.ENOSPC) {
+		return false
+	}
+
+	// Anything else is most likely a network failure
+	return true
+}
+
+func retryDelayFor(attempt int) time.Duration {
+	d := retryDelay
+	for i := 1; i < attempt && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+
+	return d
+}
+
+// failDownload records a failed attempt, queuing the request again after a backoff when the error is retryable and
+// attempts remain, or moving it into the failed state otherwise. It returns true when the request has failed for good.
+func failDownload(r DownloadRequest, downloadErr error) bool {
+	r, err := downloadQueue.Update(r.ID, func(r *DownloadRequest) error {
+		r.Attempts++
+		r.LastError = redactToken(downloadErr.Error())
+
+		if !isRetryable(downloadErr) || r.Attempts >= maxAttempts {
+			r.State = StateFailed
+			r.NextAttempt = time.Time{}
+			return nil
+		}
+
+		r.State = StateQueued
+		r.NextAttempt = time.Now().Add(retryDelayFor(r.Attempts))
+		return nil
+	})
+	if err != nil {
+		log.Printf("[Processor] Failed to record failure of %v (%v): %v", r.Title(), r.ID, err)
+		return false
+	}
+
+	if r.State == StateQueued {
+		log.Printf("[Processor] Retrying %v at %v (attempt %v of %v)", r.Title(), r.NextAttempt.Format(time.RFC3339), r.Attempts+1, maxAttempts)
+	} else {
+		log.Printf("[Processor] Giving up on %v after %v attempts", r.Title(), r.Attempts)
+	}
+	broadcastState(r)
+
+	if r.State != StateFailed {
+		return false
+	}
+
+	hooks.Run(HookDownloadFailed, r, downloadErr)
+	return true
+}
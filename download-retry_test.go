@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/oppewala/plex-local-dl/pkg/plex"
+)
+
+func TestIsRetryable(t *testing.T) {
+	refused := &url.Error{Op: "Get", URL: "http://plex/file.mkv?X-Plex-Token=SECRET", Err: syscall.ECONNREFUSED}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"network failure", refused, true},
+		{"wrapped network failure", plex.NewRequestError("/library/parts/1/file.mkv", refused), true},
+		{"server error", plex.NewStatusError("/library/parts/1/file.mkv", http.StatusServiceUnavailable), true},
+		{"rate limited", plex.NewStatusError("/library/parts/1/file.mkv", http.StatusTooManyRequests), true},
+		{"wrapped server error", fmt.Errorf("failed: %w", plex.NewStatusError("/a", http.StatusBadGateway)), true},
+		{"bad token", plex.NewStatusError("/a", http.StatusUnauthorized), false},
+		{"removed item", plex.NewStatusError("/a", http.StatusNotFound), false},
+		{"unexpected status", plex.NewStatusError("/a", http.StatusTeapot), false},
+		{"permanent", &PermanentError{Err: errors.New("too large")}, false},
+		{"disk full", fmt.Errorf("write: %w", syscall.ENOSPC), false},
+		{"verification", &VerificationError{Path: "/a.tmp", Reason: "short"}, true},
+		{"unknown", errors.New("unexpected EOF"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestErrorHidesToken(t *testing.T) {
+	err := plex.NewRequestError("/library/parts/1/file.mkv", &url.Error{Op: "Get", URL: "http://plex/file.mkv?X-Plex-Token=SECRET", Err: context.Canceled})
+
+	if s := err.Error(); s != "plex server unavailable: /library/parts/1/file.mkv: context canceled" {
+		t.Errorf("Error() = %v", s)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Error("the cause of the failure is lost")
+	}
+}
+
+func TestRetryDelayFor(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Minute
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, time.Minute * 2},
+		{3, time.Minute * 4},
+		{6, time.Minute * 32},
+		{9, time.Minute * 256},
+		{10, maxRetryDelay},
+		{100, maxRetryDelay},
+	}
+
+	for _, tt := range tests {
+		if got := retryDelayFor(tt.attempt); got != tt.want {
+			t.Errorf("retryDelayFor(%v) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
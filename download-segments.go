@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oppewala/plex-local-dl/pkg/plex"
+)
+
+// minSegmentSize stops small parts from being split into many tiny requests
+const minSegmentSize = 64 * 1024 * 1024
+
+// segmentSaveInterval is how often the progress of a segmented download is written to disk
+const segmentSaveInterval = time.Second * 5
+
+// segmentWriter writes sequentially to a file starting at an offset, so segments can share a file, and records what
+// was written in the progress of its segment
+type segmentWriter struct {
+	file     *os.File
+	offset   int64
+	segment  *segmentRange
+	progress *segmentProgress
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	w.progress.advance(w.segment, uint64(n))
+
+	return n, err
+}
+
+// segmentProgress is kept next to the temp file of a segmented download, so an interrupted download only fetches
+// the ranges that are missing
+type segmentProgress struct {
+	mu       sync.Mutex
+	Size     uint64
+	Segments []*segmentRange
+}
+
+type segmentRange struct {
+	Start   uint64
+	End     uint64
+	Written uint64
+}
+
+// newSegmentProgress splits size into n ranges, the last one taking the remainder
+func newSegmentProgress(size uint64, n uint64) *segmentProgress {
+	p := &segmentProgress{Size: size}
+	step := size / n
+	for i := uint64(0); i < n; i++ {
+		s := &segmentRange{Start: i * step, End: (i+1)*step - 1}
+		if i == n-1 {
+			s.End = size - 1
+		}
+		p.Segments = append(p.Segments, s)
+	}
+
+	return p
+}
+
+// loadSegmentProgress reads the progress of an earlier attempt, it is only usable when it is for the same size and
+// the temp file it describes is still there
+func loadSegmentProgress(path string, file *os.File, size uint64) (*segmentProgress, bool) {
+	fi, err := file.Stat()
+	if err != nil || uint64(fi.Size()) != size {
+		return nil, false
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	p := &segmentProgress{}
+	err = json.Unmarshal(b, p)
+	if err != nil || p.Size != size || len(p.Segments) == 0 {
+		return nil, false
+	}
+	for _, s := range p.Segments {
+		if s.End < s.Start || s.End >= size || s.Written > s.End-s.Start+1 {
+			return nil, false
+		}
+	}
+
+	return p, true
+}
+
+func (p *segmentProgress) advance(s *segmentRange, n uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s.Written += n
+}
+
+// next is where the segment continues from
+func (p *segmentProgress) next(s *segmentRange) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return s.Start + s.Written
+}
+
+func (p *segmentProgress) written() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var n uint64
+	for _, s := range p.Segments {
+		n += s.Written
+	}
+
+	return n
+}
+
+// save writes the progress to path, file is synced first so the progress never claims more than is on disk
+func (p *segmentProgress) save(path string, file *os.File) error {
+	err := file.Sync()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	b, err := json.Marshal(p)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path+".tmp", b, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// supportsRanges checks if the server will return partial content for the part
+func supportsRanges(ctx context.Context, key string) (bool, error) {
+	req, err := partRequest(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	res, err := plexClient.Do(req)
+	if err != nil {
+		return false, plex.NewRequestError(key, err)
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		return false, plex.NewStatusError(key, res.StatusCode)
+	}
+
+	return res.StatusCode == http.StatusPartialContent, nil
+}
+
+// downloadSegments splits the part into byte ranges that are fetched concurrently into file. The progress of each
+// range is saved alongside the file, so an interrupted download picks up the ranges where they stopped.
+func downloadSegments(ctx context.Context, file *os.File, r DownloadRequest, counter *DownloadTracker) error {
+	progressPath := segmentsProgressPath(downloadPath(r))
+	p, ok := loadSegmentProgress(progressPath, file, r.Part.Size)
+	if ok {
+		log.Printf("[Processor] Resuming %v in %v segments, %v of %v bytes already downloaded", r.Title(), len(p.Segments), p.written(), r.Part.Size)
+	} else {
+		n := uint64(segments)
+		if r.Part.Size/n < minSegmentSize {
+			n = r.Part.Size / minSegmentSize
+		}
+		log.Printf("[Processor] Downloading %v in %v segments", r.Title(), n)
+
+		err := file.Truncate(int64(r.Part.Size))
+		if err != nil {
+			return err
+		}
+		p = newSegmentProgress(r.Part.Size, n)
+		err = p.save(progressPath, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	done := p.written()
+	counter.Offset = done
+	counter.Total = done
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for _, s := range p.Segments {
+		if p.next(s) > s.End {
+			continue
+		}
+
+		wg.Add(1)
+		go func(s *segmentRange) {
+			defer wg.Done()
+
+			err := downloadSegment(ctx, file, r.Part.Key, s, p, counter)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(s)
+	}
+
+	stop := make(chan struct{})
+	saved := make(chan struct{})
+	go func() {
+		defer close(saved)
+
+		t := time.NewTicker(segmentSaveInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				if err := p.save(progressPath, file); err != nil {
+					log.Printf("[Processor] Failed to save segment progress of %v: %v", r.Title(), err)
+				}
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(stop)
+	<-saved
+
+	if firstErr != nil {
+		if err := p.save(progressPath, file); err != nil {
+			log.Printf("[Processor] Failed to save segment progress of %v: %v", r.Title(), err)
+		}
+		return firstErr
+	}
+
+	_ = os.Remove(progressPath)
+	return nil
+}
+
+// segmentsTempPath is the temp file of a segmented download of the part at path
+func segmentsTempPath(path string) string {
+	return path + ".segments.tmp"
+}
+
+// segmentsProgressPath holds the progress of each segment written to segmentsTempPath
+func segmentsProgressPath(path string) string {
+	return path + ".segments.json"
+}
+
+func downloadSegment(ctx context.Context, file *os.File, key string, s *segmentRange, p *segmentProgress, counter *DownloadTracker) error {
+	start, end := p.next(s), s.End
+	req, err := partRequest(ctx, key)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	res, err := plexClient.Do(req)
+	if err != nil {
+		return plex.NewRequestError(key, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusPartialContent {
+		return plex.NewStatusError(key, res.StatusCode)
+	}
+
+	w := &segmentWriter{file: file, offset: int64(start), segment: s, progress: p}
+	written, err := io.Copy(w, io.TeeReader(newLimitedReader(ctx, res.Body, bandwidth), counter))
+	if err != nil {
+		return err
+	}
+	if uint64(written) != end-start+1 {
+		return fmt.Errorf("segment %v-%v of %v ended after %v bytes", start, end, key, written)
+	}
+
+	return nil
+}
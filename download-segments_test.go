@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oppewala/plex-local-dl/pkg/plex"
+)
+
+// testPart serves content as the part at /library/parts/1/file.mkv through handler, which gets to answer a request
+// first and returns false to let the content be served normally. The downloads write below a temporary mediaPath.
+func testPart(t *testing.T, content []byte, handler func(w http.ResponseWriter, r *http.Request) bool) DownloadRequest {
+	dir, err := ioutil.TempDir("", "media")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler != nil && handler(w, r) {
+			return
+		}
+		http.ServeContent(w, r, "file.mkv", time.Time{}, bytes.NewReader(content))
+	}))
+
+	oldUrl, oldToken, oldClient, oldBandwidth, oldMedia := plexUrl, plexToken, plexClient, bandwidth, mediaPath
+	t.Cleanup(func() {
+		srv.Close()
+		plexUrl, plexToken, plexClient, bandwidth, mediaPath = oldUrl, oldToken, oldClient, oldBandwidth, oldMedia
+		_ = os.RemoveAll(dir)
+	})
+
+	plexUrl, plexToken, plexClient = srv.URL, "token", srv.Client()
+	bandwidth = newLimiter(BandwidthSchedule{})
+	mediaPath = dir
+
+	return DownloadRequest{
+		ID:       newRequestID(),
+		Metadata: plex.Metadata{Type: "movie", Title: "Film"},
+		Part:     plex.Part{Key: "/library/parts/1/file.mkv", File: "/movies/film.mkv", Size: uint64(len(content))},
+	}
+}
+
+// testTracker is a tracker whose progress updates are thrown away
+func testTracker(t *testing.T, r DownloadRequest) *DownloadTracker {
+	h := &Hub{broadcast: make(chan Message)}
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go func() {
+		for {
+			select {
+			case <-h.broadcast:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return &DownloadTracker{ID: r.ID, ExpectedTotal: r.Part.Size, StartTime: time.Now(), Hub: h}
+}
+
+func testContent(size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(b)
+
+	return b
+}
+
+func TestDownloadSegmentsResume(t *testing.T) {
+	content := testContent(3000)
+
+	var mu sync.Mutex
+	var ranges []string
+	failLast := true
+	r := testPart(t, content, func(w http.ResponseWriter, req *http.Request) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		ranges = append(ranges, req.Header.Get("Range"))
+		if failLast && strings.HasPrefix(req.Header.Get("Range"), "bytes=2000-") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		}
+		return false
+	})
+	path := downloadPath(r)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// An earlier attempt finished the first segment and half of the second
+	file, err := os.OpenFile(segmentsTempPath(path), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := file.Truncate(3000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt(content[:1500], 0); err != nil {
+		t.Fatal(err)
+	}
+	p := newSegmentProgress(3000, 3)
+	p.Segments[0].Written = 1000
+	p.Segments[1].Written = 500
+	if err := p.save(segmentsProgressPath(path), file); err != nil {
+		t.Fatal(err)
+	}
+
+	counter := testTracker(t, r)
+	if err := downloadSegments(context.Background(), file, r, counter); err == nil {
+		t.Fatal("downloadSegments() succeeded while the last segment fails")
+	}
+
+	// The failure cancels the second segment wherever it had got to, nothing is lost from before the attempt
+	saved, ok := loadSegmentProgress(segmentsProgressPath(path), file, 3000)
+	if !ok {
+		t.Fatal("progress was not saved after the failure")
+	}
+	if saved.Segments[0].Written != 1000 || saved.Segments[1].Written < 500 || saved.Segments[2].Written != 0 {
+		t.Errorf("saved progress = %v %v %v, want 1000, at least 500 and 0", saved.Segments[0].Written, saved.Segments[1].Written, saved.Segments[2].Written)
+	}
+
+	want := make([]string, 0)
+	for _, s := range saved.Segments {
+		if next := saved.next(s); next <= s.End {
+			want = append(want, fmt.Sprintf("bytes=%d-%d", next, s.End))
+		}
+	}
+
+	mu.Lock()
+	failLast = false
+	ranges = nil
+	mu.Unlock()
+
+	counter = testTracker(t, r)
+	if err := downloadSegments(context.Background(), file, r, counter); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(ranges)
+	if !reflect.DeepEqual(ranges, want) {
+		t.Errorf("requested %v, want only the missing ranges %v", ranges, want)
+	}
+	if counter.Total != 3000 || counter.Transferred() != 3000-saved.written() {
+		t.Errorf("total = %v, transferred = %v, want 3000 and %v", counter.Total, counter.Transferred(), 3000-saved.written())
+	}
+	if _, err := os.Stat(segmentsProgressPath(path)); !os.IsNotExist(err) {
+		t.Errorf("progress file left behind after the download finished: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(segmentsTempPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("downloaded file does not match the part")
+	}
+}
+
+func TestLoadSegmentProgressRejectsStaleFiles(t *testing.T) {
+	r := testPart(t, testContent(3000), nil)
+	path := downloadPath(r)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.OpenFile(segmentsTempPath(path), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := file.Truncate(3000); err != nil {
+		t.Fatal(err)
+	}
+	if err := newSegmentProgress(3000, 3).save(segmentsProgressPath(path), file); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := loadSegmentProgress(segmentsProgressPath(path), file, 3000); !ok {
+		t.Error("progress for the same size was rejected")
+	}
+	if _, ok := loadSegmentProgress(segmentsProgressPath(path), file, 4000); ok {
+		t.Error("progress for another size was accepted")
+	}
+
+	// The temp file was removed, e.g. after failing verification, and created again empty
+	if err := file.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loadSegmentProgress(segmentsProgressPath(path), file, 3000); ok {
+		t.Error("progress was accepted for an empty temp file")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/oppewala/plex-local-dl/pkg/plex"
+)
+
+// sampleSize is the number of bytes from the start of a part that are hashed when comparing a local copy
+const sampleSize = 1024 * 1024
+
+// ErrAlreadyDownloaded is returned when the destination already holds a copy of the part
+var ErrAlreadyDownloaded = errors.New("part has already been downloaded")
+
+// localCopyMatches checks if the file at path has the size of the remote part and, when verifySample is enabled,
+// that the start of both files hashes the same
+func localCopyMatches(ctx context.Context, r DownloadRequest, path string) (bool, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// The size of a transcode isn't known up front, so any existing file is kept
+	if r.Transcode != nil {
+		return !fi.IsDir(), nil
+	}
+
+	if fi.IsDir() || uint64(fi.Size()) != r.Part.Size {
+		log.Printf("[Processor] Existing file %v does not match remote size (%v != %v)", path, fi.Size(), r.Part.Size)
+		return false, nil
+	}
+	if !verifySample {
+		return true, nil
+	}
+
+	local, err := localSample(path)
+	if err != nil {
+		return false, err
+	}
+	remote, err := remoteSample(ctx, r)
+	if err != nil {
+		return false, err
+	}
+
+	if !bytes.Equal(local, remote) {
+		log.Printf("[Processor] Existing file %v does not match remote content", path)
+		return false, nil
+	}
+	return true, nil
+}
+
+func localSample(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return hashSample(f)
+}
+
+func remoteSample(ctx context.Context, r DownloadRequest) ([]byte, error) {
+	req, err := partRequest(ctx, r.Part.Key)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", sampleSize-1))
+
+	res, err := plexClient.Do(req)
+	if err != nil {
+		return nil, plex.NewRequestError(r.Part.Key, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		return nil, plex.NewStatusError(r.Part.Key, res.StatusCode)
+	}
+
+	// Only the start is read when the server ignores the range
+	return hashSample(res.Body)
+}
+
+func hashSample(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, io.LimitReader(r, sampleSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
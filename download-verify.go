@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// VerificationError is returned when a completed download does not look like the remote part, it is retryable
+type VerificationError struct {
+	Path   string
+	Reason string
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("verification of %v failed: %v", e.Path, e.Reason)
+}
+
+// verifyDownload checks the temp file of a finished download before it is moved into place. Oversized or
+// unrecognisable files are removed, short files are kept so the next attempt resumes them.
+func verifyDownload(r DownloadRequest, tmpPath string, written uint64) error {
+	if r.Transcode == nil && r.Part.Size > 0 && written != r.Part.Size {
+		if written > r.Part.Size {
+			_ = os.Remove(tmpPath)
+		}
+		return &VerificationError{Path: tmpPath, Reason: fmt.Sprintf("expected %v bytes, received %v", r.Part.Size, written)}
+	}
+
+	if !probeContainer {
+		return nil
+	}
+
+	container := r.Part.Container
+	if r.Transcode != nil {
+		container = "mp4"
+	}
+
+	err := probeFile(tmpPath, container)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return &VerificationError{Path: tmpPath, Reason: err.Error()}
+	}
+
+	return nil
+}
+
+// probeFile checks the header of the file matches the container, unknown containers are accepted
+func probeFile(path string, container string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := make([]byte, 189)
+	n, err := io.ReadFull(f, h)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	h = h[:n]
+
+	valid := true
+	switch strings.ToLower(container) {
+	case "mkv", "webm":
+		valid = bytes.HasPrefix(h, []byte{0x1A, 0x45, 0xDF, 0xA3})
+	case "mp4", "m4v", "mov":
+		valid = len(h) >= 8 && isMp4Box(h[4:8])
+	case "avi":
+		valid = len(h) >= 12 && bytes.Equal(h[0:4], []byte("RIFF")) && bytes.Equal(h[8:12], []byte("AVI "))
+	case "mpegts", "ts":
+		valid = len(h) >= 189 && h[0] == 0x47 && h[188] == 0x47
+	}
+
+	if !valid {
+		return fmt.Errorf("file header does not match %v container", container)
+	}
+	return nil
+}
+
+func isMp4Box(t []byte) bool {
+	for _, b := range []string{"ftyp", "moov", "mdat", "free", "skip", "wide"} {
+		if string(t) == b {
+			return true
+		}
+	}
+
+	return false
+}
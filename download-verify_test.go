@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oppewala/plex-local-dl/pkg/plex"
+)
+
+func writeTemp(t *testing.T, content []byte) string {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "file.tmp")
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func tsHeader() []byte {
+	h := make([]byte, 189)
+	h[0], h[188] = 0x47, 0x47
+
+	return h
+}
+
+func TestProbeFile(t *testing.T) {
+	mkv := []byte{0x1A, 0x45, 0xDF, 0xA3, 0x01, 0x00}
+	mp4 := append([]byte{0x00, 0x00, 0x00, 0x20}, []byte("ftypisom")...)
+	avi := append([]byte("RIFF\x00\x00\x00\x00AVI "), 0x00)
+	html := []byte("<html><body>Unauthorized</body></html>")
+
+	tests := []struct {
+		name      string
+		container string
+		content   []byte
+		wantErr   bool
+	}{
+		{"mkv", "mkv", mkv, false},
+		{"webm", "webm", mkv, false},
+		{"mkv case", "MKV", mkv, false},
+		{"mkv mismatch", "mkv", html, true},
+		{"mp4", "mp4", mp4, false},
+		{"mp4 moov", "mov", append([]byte{0, 0, 0, 8}, []byte("moov")...), false},
+		{"mp4 mismatch", "mp4", html, true},
+		{"mp4 too short", "mp4", []byte{0, 0, 0}, true},
+		{"avi", "avi", avi, false},
+		{"avi mismatch", "avi", mkv, true},
+		{"ts", "mpegts", tsHeader(), false},
+		{"ts too short", "ts", tsHeader()[:100], true},
+		{"unknown container", "wmv", html, false},
+		{"empty mkv", "mkv", []byte{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := probeFile(writeTemp(t, tt.content), tt.container)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("probeFile() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyDownload(t *testing.T) {
+	defer func(p bool) { probeContainer = p }(probeContainer)
+
+	mkv := append([]byte{0x1A, 0x45, 0xDF, 0xA3}, bytes.Repeat([]byte{0}, 96)...)
+	part := DownloadRequest{Part: plex.Part{Size: 100, Container: "mkv"}}
+	transcode := DownloadRequest{Part: plex.Part{Size: 100, Container: "mkv"}, Transcode: &TranscodeProfile{Name: "720p"}}
+
+	tests := []struct {
+		name        string
+		r           DownloadRequest
+		content     []byte
+		written     uint64
+		probe       bool
+		wantErr     bool
+		wantRemoved bool
+	}{
+		{"complete", part, mkv, 100, false, false, false},
+		{"short is kept to resume", part, mkv[:60], 60, false, true, false},
+		{"oversized is removed", part, append(mkv, 0), 101, false, true, true},
+		{"header checked", part, mkv, 100, true, false, false},
+		{"bad header is removed", part, bytes.Repeat([]byte("<"), 100), 100, true, true, true},
+		{"header not checked when disabled", part, bytes.Repeat([]byte("<"), 100), 100, false, false, false},
+		{"transcode size is not known", transcode, append([]byte{0, 0, 0, 8}, []byte("ftyp")...), 8, true, false, false},
+		{"transcode is probed as mp4", transcode, mkv, 100, true, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probeContainer = tt.probe
+			path := writeTemp(t, tt.content)
+
+			err := verifyDownload(tt.r, path, tt.written)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyDownload() = %v, wantErr %v", err, tt.wantErr)
+			}
+			var ve *VerificationError
+			if err != nil && !errors.As(err, &ve) {
+				t.Errorf("verifyDownload() = %v, want a VerificationError", err)
+			}
+
+			_, statErr := os.Stat(path)
+			if removed := os.IsNotExist(statErr); removed != tt.wantRemoved {
+				t.Errorf("removed = %v, want %v", removed, tt.wantRemoved)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HistoryEntry records how a download ended, once it is done, has failed for good or was cancelled
+type HistoryEntry struct {
+	ID           string
+	RatingKey    string
+	Type         string
+	Title        string
+	Status       string
+	Bytes        uint64
+	Duration     time.Duration
+	AverageSpeed uint64 // bytes per second
+	PartKey      string
+	Path         string
+	MovedFrom    string `json:",omitempty"` // where the file was downloaded to when a hook moved it to Path
+	Error        string `json:",omitempty"`
+	StartedAt    time.Time
+	FinishedAt   time.Time
+}
+
+// HistoryFilter limits the entries returned by Query, zero values match everything
+type HistoryFilter struct {
+	From   time.Time
+	To     time.Time
+	Type   string
+	Status string
+}
+
+// History is an append only ledger of finished downloads, kept in memory and as json lines in a file
+type History struct {
+	mu      sync.Mutex
+	path    string
+	entries []HistoryEntry
+}
+
+// loadHistory reads the ledger written by a previous run, starting an empty one when the file doesn't exist yet
+func loadHistory(path string) (*History, error) {
+	h := &History{path: path}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to open history %v: %w", path, err)
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		var e HistoryEntry
+		err := json.Unmarshal(s.Bytes(), &e)
+		if err != nil {
+			// A line cut short by a crash shouldn't lose the rest of the history
+			log.Printf("[History] Skipping unreadable entry in %v: %v", path, err)
+			continue
+		}
+		h.entries = append(h.entries, e)
+	}
+	if err := s.Err(); err != nil {
+		err = fmt.Errorf("failed to read history %v: %w", path, err)
+		return nil, err
+	}
+	log.Printf("[History] Loaded %v entries from %v", len(h.entries), path)
+
+	return h, nil
+}
+
+// Record adds the outcome of a download to the ledger. counter is the tracker of the last attempt, or nil when the
+// request never started.
+func (h *History) Record(r DownloadRequest, status string, counter *DownloadTracker, downloadErr error) {
+	h.RecordAt(r, status, downloadPath(r), counter, downloadErr)
+}
+
+// RecordAt is Record for a download that has been moved to path since it finished
+func (h *History) RecordAt(r DownloadRequest, status string, path string, counter *DownloadTracker, downloadErr error) {
+	if h == nil {
+		return
+	}
+
+	now := time.Now()
+	e := HistoryEntry{
+		ID:         r.ID,
+		RatingKey:  r.Metadata.RatingKey,
+		Type:       r.Metadata.Type,
+		Title:      r.Title(),
+		Status:     status,
+		PartKey:    r.Part.Key,
+		Path:       path,
+		StartedAt:  now,
+		FinishedAt: now,
+	}
+	if counter != nil {
+		e.Bytes = counter.Transferred()
+		e.StartedAt = counter.StartTime
+		e.Duration = e.FinishedAt.Sub(e.StartedAt)
+		if s := e.Duration.Seconds(); s > 0 {
+			e.AverageSpeed = uint64(float64(e.Bytes) / s)
+		}
+	}
+	if path != downloadPath(r) {
+		e.MovedFrom = downloadPath(r)
+	}
+	if downloadErr != nil {
+		e.Error = redactToken(downloadErr.Error())
+	}
+
+	err := h.append(e)
+	if err != nil {
+		log.Printf("[History] Failed to record %v of %v: %v", status, r.Title(), err)
+	}
+}
+
+func (h *History) append(e HistoryEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries = append(h.entries, e)
+
+	err = os.MkdirAll(filepath.Dir(h.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// MovedTo returns where a hook last moved the file downloaded to path, or an empty string if it wasn't moved
+func (h *History) MovedTo(path string) string {
+	if h == nil {
+		return ""
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		e := h.entries[i]
+		if e.Status == StateDone && e.MovedFrom == path {
+			return e.Path
+		}
+	}
+
+	return ""
+}
+
+// Query returns the entries matching the filter, most recent first
+func (h *History) Query(f HistoryFilter) []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries := make([]HistoryEntry, 0)
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		e := h.entries[i]
+		if !f.From.IsZero() && e.FinishedAt.Before(f.From) {
+			continue
+		}
+		if !f.To.IsZero() && !e.FinishedAt.Before(f.To) {
+			continue
+		}
+		if f.Type != "" && e.Type != f.Type {
+			continue
+		}
+		if f.Status != "" && e.Status != f.Status {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+// parseHistoryTime accepts either a timestamp or a date, a date used as the end of a range includes the whole day
+func parseHistoryTime(v string, end bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%v', expected RFC 3339 or yyyy-mm-dd", v)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, nil
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	HookDownloadStart    = "download-start"
+	HookDownloadComplete = "download-complete"
+	HookDownloadFailed   = "download-failed"
+)
+
+// hookTimeout stops a misbehaving hook from holding up a worker forever
+const hookTimeout = time.Minute * 10
+
+// Hook is an action run when a download changes state, vars holds the details of the download
+type Hook interface {
+	Run(ctx context.Context, vars map[string]string) error
+}
+
+// HookConfig is a single entry in the hooks file. Command, URL, Body and Destination are templates that can use
+// the download details, e.g. {{.Title}} or {{.Path}}. {{json .Title}} quotes and escapes a value for a json Body.
+type HookConfig struct {
+	Name        string
+	Events      []string
+	Type        string
+	Command     []string
+	URL         string
+	Method      string
+	Body        string
+	Destination string
+}
+
+type HookRunner struct {
+	hooks []configuredHook
+}
+
+type configuredHook struct {
+	name   string
+	events []string
+	hook   Hook
+}
+
+type commandHook struct {
+	args []*template.Template
+}
+
+type httpHook struct {
+	method string
+	url    *template.Template
+	body   *template.Template
+}
+
+type moveHook struct {
+	destination *template.Template
+}
+
+// loadHooks reads the hooks file, a json array of HookConfig
+func loadHooks(path string) (*HookRunner, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("failed to read hooks file %v: %w", path, err)
+		return nil, err
+	}
+
+	var configs []HookConfig
+	err = json.Unmarshal(b, &configs)
+	if err != nil {
+		err = fmt.Errorf("failed to convert hooks file %v from json: %w", path, err)
+		return nil, err
+	}
+
+	hr := &HookRunner{hooks: make([]configuredHook, 0, len(configs))}
+	for _, c := range configs {
+		h, err := newHook(c)
+		if err != nil {
+			err = fmt.Errorf("invalid hook '%v': %w", c.Name, err)
+			return nil, err
+		}
+
+		hr.hooks = append(hr.hooks, configuredHook{name: c.Name, events: c.Events, hook: h})
+	}
+	log.Printf("[Hooks] Loaded %v hooks from %v", len(hr.hooks), path)
+
+	return hr, nil
+}
+
+// hookFuncs are the functions available to hook templates
+var hookFuncs = template.FuncMap{
+	"json": jsonString,
+}
+
+func parseHookTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(hookFuncs).Parse(text)
+}
+
+// jsonString returns v as a quoted json string, so titles and errors containing quotes still produce a valid body
+func jsonString(v string) (string, error) {
+	b, err := json.Marshal(v)
+
+	return string(b), err
+}
+
+func newHook(c HookConfig) (Hook, error) {
+	switch c.Type {
+	case "command":
+		if len(c.Command) == 0 {
+			return nil, fmt.Errorf("command hooks need a Command")
+		}
+
+		h := &commandHook{args: make([]*template.Template, 0, len(c.Command))}
+		for _, a := range c.Command {
+			t, err := parseHookTemplate(c.Name, a)
+			if err != nil {
+				return nil, err
+			}
+			h.args = append(h.args, t)
+		}
+		return h, nil
+	case "http":
+		u, err := parseHookTemplate(c.Name, c.URL)
+		if err != nil {
+			return nil, err
+		}
+		b, err := parseHookTemplate(c.Name, c.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		m := c.Method
+		if m == "" {
+			m = http.MethodPost
+		}
+		return &httpHook{method: m, url: u, body: b}, nil
+	case "move":
+		d, err := parseHookTemplate(c.Name, c.Destination)
+		if err != nil {
+			return nil, err
+		}
+		return &moveHook{destination: d}, nil
+	default:
+		return nil, fmt.Errorf("unknown hook type '%v'", c.Type)
+	}
+}
+
+// Run calls every hook registered for the event in order, failures are logged and do not stop later hooks. It returns
+// the path of the download once the hooks are done, which differs from downloadPath when a hook moved the file.
+func (hr *HookRunner) Run(event string, r DownloadRequest, downloadErr error) string {
+	if hr == nil {
+		return downloadPath(r)
+	}
+
+	vars := hookVars(event, r, downloadErr)
+	for _, h := range hr.hooks {
+		if !containsState(h.events, event) {
+			continue
+		}
+
+		log.Printf("[Hooks] Running %v for %v (%v)", h.name, event, r.Title())
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		err := h.hook.Run(ctx, vars)
+		cancel()
+		if err != nil {
+			log.Printf("[Hooks] %v failed for %v: %v", h.name, r.Title(), err)
+		}
+	}
+
+	return vars["Path"]
+}
+
+func hookVars(event string, r DownloadRequest, downloadErr error) map[string]string {
+	m := r.Metadata
+	v := map[string]string{
+		"Event":            event,
+		"ID":               r.ID,
+		"Title":            r.Title(),
+		"MediaTitle":       m.Title,
+		"ParentTitle":      m.ParentTitle,
+		"GrandparentTitle": m.GrandparentTitle,
+		"Type":             m.Type,
+		"RatingKey":        m.RatingKey,
+		"Year":             strconv.Itoa(m.Year),
+		"Index":            strconv.Itoa(m.Index),
+		"ParentIndex":      strconv.Itoa(m.ParentIndex),
+		"PartKey":          r.Part.Key,
+		"RemoteFile":       r.Part.File,
+		"Size":             strconv.FormatUint(r.Part.Size, 10),
+		"Path":             downloadPath(r),
+		"Error":            "",
+	}
+	if downloadErr != nil {
+		v["Error"] = redactToken(downloadErr.Error())
+	}
+
+	return v
+}
+
+func render(t *template.Template, vars map[string]string) (string, error) {
+	var b bytes.Buffer
+	err := t.Execute(&b, vars)
+
+	return b.String(), err
+}
+
+// Run executes the command with the download details as PLEXDL_ prefixed environment variables
+func (h *commandHook) Run(ctx context.Context, vars map[string]string) error {
+	args := make([]string, 0, len(h.args))
+	for _, t := range h.args {
+		a, err := render(t, vars)
+		if err != nil {
+			return err
+		}
+		args = append(args, a)
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = os.Environ()
+	for k, v := range vars {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("PLEXDL_%v=%v", strings.ToUpper(k), v))
+	}
+
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		log.Printf("[Hooks] %v output: %s", args[0], out)
+	}
+
+	return err
+}
+
+func (h *httpHook) Run(ctx context.Context, vars map[string]string) error {
+	u, err := render(h.url, vars)
+	if err != nil {
+		return err
+	}
+	b, err := render(h.body, vars)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, h.method, u, strings.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if b != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%v %v responded with %v", h.method, u, res.StatusCode)
+	}
+	return nil
+}
+
+// Run moves the downloaded file, along with its subtitles, nfo and artwork, into the destination directory, copying
+// them when the destination is on another volume. Path is updated so later hooks and the scan use the new location.
+func (h *moveHook) Run(ctx context.Context, vars map[string]string) error {
+	dir, err := render(h.destination, vars)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	src := vars["Path"]
+	dst := filepath.Join(dir, filepath.Base(src))
+	log.Printf("[Hooks] Moving %v to %v", src, dst)
+
+	err = moveFile(ctx, src, dst)
+	if err != nil {
+		return err
+	}
+	vars["Path"] = dst
+
+	for _, s := range sidecarFiles(src) {
+		err := moveFile(ctx, s, filepath.Join(dir, filepath.Base(s)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sidecarFiles finds the files written next to a video, named <video>.<suffix> or <video>-<suffix>
+func sidecarFiles(video string) []string {
+	base := strings.TrimSuffix(video, filepath.Ext(video))
+	pattern := escapeGlob(filepath.Base(base))
+
+	var files []string
+	for _, p := range []string{pattern + ".*", pattern + "-*"} {
+		matches, _ := filepath.Glob(filepath.Join(filepath.Dir(base), p))
+		for _, m := range matches {
+			if m == video || strings.HasSuffix(m, ".tmp") {
+				continue
+			}
+			files = append(files, m)
+		}
+	}
+
+	return files
+}
+
+func escapeGlob(s string) string {
+	r := strings.NewReplacer("*", "[*]", "?", "[?]", "[", "[[]")
+	return r.Replace(s)
+}
+
+func moveFile(ctx context.Context, src string, dst string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	return copyAndRemove(ctx, src, dst)
+}
+
+// copyAndRemove copies src to dst and removes src, the copy stops when ctx is cancelled and src is left in place
+func copyAndRemove(ctx context.Context, src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, &contextReader{ctx: ctx, r: in})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(dst + ".tmp")
+		return err
+	}
+
+	err = os.Rename(dst+".tmp", dst)
+	if err != nil {
+		return err
+	}
+
+	_ = in.Close()
+	return os.Remove(src)
+}
+
+// contextReader fails reads once ctx is cancelled so a long copy can be interrupted
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return cr.r.Read(p)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestHookBodyJSON(t *testing.T) {
+	body, err := parseHookTemplate("notify", `{"title": {{json .Title}}, "error": {{json .Error}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars := map[string]string{
+		"Title": `Show - "Pilot"`,
+		"Error": "plex server unavailable: /library/parts/1/file.mkv: dial tcp: connection refused\n",
+	}
+	b, err := render(body, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]string
+	if err := json.Unmarshal([]byte(b), &got); err != nil {
+		t.Fatalf("body %v is not valid json: %v", b, err)
+	}
+	want := map[string]string{"title": vars["Title"], "error": vars["Error"]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("body = %v, want %v", got, want)
+	}
+}
+
+func TestRedactToken(t *testing.T) {
+	defer func(token string) { plexToken = token }(plexToken)
+	plexToken = "SECRET"
+
+	got := redactToken(`Get "http://plex/file.mkv?X-Plex-Token=SECRET": dial tcp: connection refused`)
+	want := `Get "http://plex/file.mkv?X-Plex-Token=<token>": dial tcp: connection refused`
+	if got != want {
+		t.Errorf("redactToken() = %v, want %v", got, want)
+	}
+}
@@ -8,7 +8,10 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -18,34 +21,149 @@ import (
 )
 
 var (
-	plexUrl    string
-	plexToken  string
-	plexServer *plex.Server
-	store      *storage.Storage
-	hub        *Hub
-	mediaPath  string
+	plexUrl         string
+	plexToken       string
+	plexServer      *plex.Server
+	plexClient      *http.Client
+	store           *storage.Storage
+	hub             *Hub
+	mediaPath       string
+	dataPath        string
+	downloadQueue   *DownloadQueue
+	history         *History
+	maxAttempts     int
+	retryDelay      time.Duration
+	bandwidth       *Limiter
+	verifySample    bool
+	probeContainer  bool
+	segments        int
+	movieTemplate   string
+	episodeTemplate string
+	storageQuota    uint64
+	scanner         *ScanNotifier
+	hooks           *HookRunner
+	subtitles       bool
+	exportMetadata  bool
+	defaultQuality  plex.QualityRules
 )
 
 func main() {
 	var port string
 	var wait time.Duration
 	var storageConnectionString string
+	var workers int
+	var bandwidthLimit string
+	var bandwidthSchedule string
+	var pathMap string
+	var quota string
+	var localPlexUrl string
+	var localPlexToken string
+	var autoscanUrl string
+	var scanPathMap string
+	var scanDelay time.Duration
+	var hooksConfig string
+	var maxSize string
+	var plexTimeout time.Duration
+	var plexProxy string
+	var plexOptions plex.ClientOptions
 	flag.StringVar(&plexUrl, "plexUrl", os.Getenv("PLEX_URL"), "the token for the source plex server - can be set through environment variable PLEX_URL")
 	flag.StringVar(&plexToken, "plexToken", os.Getenv("PLEX_TOKEN"), "the url for the source plex server - can be set through environment variable PLEX_TOKEN")
+	flag.DurationVar(&plexTimeout, "plexTimeout", plex.DefaultTimeout, "the longest a request to the plex api can take, downloads are only limited by connection timeouts - e.g. 30s or 2m (optional)")
+	flag.DurationVar(&plexOptions.DialTimeout, "plexDialTimeout", plex.DefaultClientOptions.DialTimeout, "the longest connecting to a plex server can take - e.g. 10s (optional)")
+	flag.DurationVar(&plexOptions.ResponseHeaderTimeout, "plexHeaderTimeout", plex.DefaultClientOptions.ResponseHeaderTimeout, "the longest a plex server can take to start responding, including transcodes starting up - e.g. 1m (optional)")
+	flag.DurationVar(&plexOptions.KeepAlive, "plexKeepAlive", plex.DefaultClientOptions.KeepAlive, "the interval between keep-alive probes on connections to a plex server - e.g. 15s (optional)")
+	flag.StringVar(&plexProxy, "plexProxy", os.Getenv("PLEX_PROXY"), "the url of a proxy for requests to the source plex server, HTTP_PROXY and HTTPS_PROXY are used when empty - can be set through environment variable PLEX_PROXY")
 	flag.StringVar(&storageConnectionString, "storageConnection", os.Getenv("AZURE_STORAGE"), "the connection string to the storage account - can be set through environment variable AZURE_STORAGE")
 	flag.StringVar(&port, "port", "8080", "the port to run the UI on - e.g. 8080 (optional)")
 	flag.StringVar(&mediaPath, "mediaPath", "/data/media", "the directory to download media to")
-	flag.DurationVar(&wait, "graceful-timeout", time.Second*15, "the duration for which the server gracefully wait for existing connections to finish - e.g. 15s or 1m (optional)")
+	flag.StringVar(&pathMap, "pathMap", os.Getenv("PATH_MAP"), "remote path prefixes to replace when building local paths, e.g. /data/media/mnt/remote/tv=/tv - can be set through environment variable PATH_MAP")
+	flag.StringVar(&movieTemplate, "movieTemplate", os.Getenv("MOVIE_TEMPLATE"), "naming template for movies relative to mediaPath, e.g. movies/{Title} ({Year})/{Title} ({Year}).{Container} - can be set through environment variable MOVIE_TEMPLATE")
+	flag.StringVar(&episodeTemplate, "episodeTemplate", os.Getenv("EPISODE_TEMPLATE"), "naming template for episodes relative to mediaPath, e.g. tv/{GrandparentTitle}/Season {ParentIndex:02}/{GrandparentTitle} - S{ParentIndex:02}E{Index:02}.{Container} - can be set through environment variable EPISODE_TEMPLATE")
+	flag.StringVar(&quota, "quota", os.Getenv("STORAGE_QUOTA"), "the maximum size of mediaPath, e.g. 2TB - unlimited when empty - can be set through environment variable STORAGE_QUOTA")
+	flag.StringVar(&localPlexUrl, "localPlexUrl", os.Getenv("LOCAL_PLEX_URL"), "the url of the local plex server to scan after downloads (optional) - can be set through environment variable LOCAL_PLEX_URL")
+	flag.StringVar(&localPlexToken, "localPlexToken", os.Getenv("LOCAL_PLEX_TOKEN"), "the token for the local plex server - can be set through environment variable LOCAL_PLEX_TOKEN")
+	flag.StringVar(&autoscanUrl, "autoscanUrl", os.Getenv("AUTOSCAN_URL"), "the url of an autoscan instance to trigger after downloads (optional) - can be set through environment variable AUTOSCAN_URL")
+	flag.StringVar(&scanPathMap, "scanPathMap", os.Getenv("SCAN_PATH_MAP"), "local path prefixes to replace with the paths seen by the local plex server, e.g. /data/media=/mnt/media - can be set through environment variable SCAN_PATH_MAP")
+	flag.DurationVar(&scanDelay, "scanDelay", time.Minute*10, "the longest a scan is held back waiting for the rest of a season - e.g. 10m (optional)")
+	flag.StringVar(&hooksConfig, "hooksConfig", os.Getenv("HOOKS_CONFIG"), "a json file of hooks to run when downloads start, complete or fail (optional) - can be set through environment variable HOOKS_CONFIG")
+	flag.StringVar(&defaultQuality.MaxResolution, "maxResolution", os.Getenv("MAX_RESOLUTION"), "the highest resolution version to download when an item has several, e.g. 1080 or 4k - can be set through environment variable MAX_RESOLUTION")
+	flag.StringVar(&defaultQuality.PreferredCodec, "preferredCodec", os.Getenv("PREFERRED_CODEC"), "the video codec to prefer when an item has several versions, e.g. hevc - can be set through environment variable PREFERRED_CODEC")
+	flag.IntVar(&defaultQuality.MaxBitrate, "maxBitrate", envInt("MAX_BITRATE", 0), "the highest bitrate in kbps to download when an item has several versions - can be set through environment variable MAX_BITRATE")
+	flag.StringVar(&maxSize, "maxSize", os.Getenv("MAX_SIZE"), "the largest version to download when an item has several, e.g. 20GB - can be set through environment variable MAX_SIZE")
+	flag.StringVar(&dataPath, "dataPath", envString("DATA_PATH", "/data/config"), "the directory to keep the download queue and history in - can be set through environment variable DATA_PATH")
+	flag.IntVar(&workers, "workers", envInt("DOWNLOAD_WORKERS", 1), "the number of downloads to run in parallel - can be set through environment variable DOWNLOAD_WORKERS")
+	flag.IntVar(&segments, "segments", envInt("DOWNLOAD_SEGMENTS", 1), "the number of concurrent range requests used to download a single large file - can be set through environment variable DOWNLOAD_SEGMENTS")
+	flag.IntVar(&maxAttempts, "maxAttempts", envInt("DOWNLOAD_MAX_ATTEMPTS", 5), "the number of times a download is attempted before it is marked as failed - can be set through environment variable DOWNLOAD_MAX_ATTEMPTS")
+	flag.DurationVar(&retryDelay, "retryDelay", time.Minute, "the delay before the first retry of a failed download, doubled after each attempt - e.g. 30s or 5m (optional)")
+	flag.StringVar(&bandwidthLimit, "bandwidthLimit", os.Getenv("BANDWIDTH_LIMIT"), "the download speed per second across all workers, e.g. 2MB - unlimited when empty - can be set through environment variable BANDWIDTH_LIMIT")
+	flag.StringVar(&bandwidthSchedule, "bandwidthSchedule", os.Getenv("BANDWIDTH_SCHEDULE"), "time windows overriding the bandwidth limit, e.g. 01:00-07:00=0,18:00-23:00=512KB - can be set through environment variable BANDWIDTH_SCHEDULE")
+	flag.BoolVar(&verifySample, "verifySample", os.Getenv("VERIFY_SAMPLE") == "true", "compare a hash of the first MB of existing files with the remote copy before skipping them - can be set through environment variable VERIFY_SAMPLE")
+	flag.BoolVar(&probeContainer, "probeContainer", os.Getenv("PROBE_CONTAINER") == "true", "check the header of mkv, mp4, avi and ts downloads before moving them into place - can be set through environment variable PROBE_CONTAINER")
+	flag.BoolVar(&subtitles, "subtitles", os.Getenv("DOWNLOAD_SUBTITLES") != "false", "download external subtitle files along with media, enabled unless set to false - can be set through environment variable DOWNLOAD_SUBTITLES")
+	flag.BoolVar(&exportMetadata, "exportMetadata", os.Getenv("EXPORT_METADATA") == "true", "write kodi style .nfo files and download posters and fanart next to media - can be set through environment variable EXPORT_METADATA")
+	flag.DurationVar(&wait, "graceful-timeout", time.Second*15, "the duration for which the server gracefully waits for existing connections and downloads to finish before checkpointing them, together with the 5s checkpoint it must stay below the container stop timeout, which docker-compose.yml sets to 30s - e.g. 15s or 1m (optional)")
 	flag.Parse()
 
 	if plexUrl == "" || plexToken == "" {
 		log.Fatal("Plex Token and URL must be provided as an environment variable or command line argument")
 	}
+	if workers < 1 {
+		log.Fatal("At least one download worker is required")
+	}
+
+	var err error
+	pathMappings, err = parsePathMappings(pathMap)
+	if err != nil {
+		log.Fatalf("[Main] Invalid path mapping: %v", err)
+	}
+
+	defaultQuality.MaxSize, err = parseBytes(maxSize)
+	if err != nil {
+		log.Fatalf("[Main] Invalid max size: %v", err)
+	}
+
+	storageQuota, err = parseBytes(quota)
+	if err != nil {
+		log.Fatalf("[Main] Invalid storage quota: %v", err)
+	}
+
+	plexOptions.Proxy = plexProxy
+	plexClient, err = plex.NewClient(plexOptions)
+	if err != nil {
+		log.Fatalf("[Main] Invalid plex client configuration: %v", err)
+	}
 
-	plexServer = plex.NewServer(plexUrl, plexToken)
+	if localPlexUrl != "" || autoscanUrl != "" {
+		scanMappings, err := parsePathMappings(scanPathMap)
+		if err != nil {
+			log.Fatalf("[Main] Invalid scan path mapping: %v", err)
+		}
+
+		var localPlex *plex.Server
+		if localPlexUrl != "" {
+			localPlex = plex.NewServer(localPlexUrl, localPlexToken, plexClient)
+		}
+		scanner = newScanNotifier(localPlex, autoscanUrl, plexClient, scanMappings, scanDelay)
+	}
+
+	if hooksConfig != "" {
+		hooks, err = loadHooks(hooksConfig)
+		if err != nil {
+			log.Fatalf("[Main] Failed to load hooks: %v", err)
+		}
+	}
+
+	schedule, err := parseBandwidthSchedule(bandwidthLimit, bandwidthSchedule)
+	if err != nil {
+		log.Fatalf("[Main] Invalid bandwidth configuration: %v", err)
+	}
+	bandwidth = newLimiter(schedule)
+
+	plexServer = plex.NewServer(plexUrl, plexToken, plexClient)
+	plexServer.Timeout = plexTimeout
 	go func() {
 		for {
-			err := populateTitles()
+			err := populateTitles(context.Background())
 			if err != nil {
 				log.Printf("[Main] Failed to populate titles: %v", err)
 			}
@@ -57,9 +175,19 @@ func main() {
 
 	store = storage.ConnectStorage(storageConnectionString)
 
+	downloadQueue, err = loadDownloadQueue(filepath.Join(dataPath, "queue.json"))
+	if err != nil {
+		log.Fatalf("[Main] Failed to load download queue: %v", err)
+	}
+
+	history, err = loadHistory(filepath.Join(dataPath, "history.jsonl"))
+	if err != nil {
+		log.Fatalf("[Main] Failed to load download history: %v", err)
+	}
+
 	hub = newHub()
 	go hub.run()
-	go chanConsumer(hub)
+	startWorkers(workers, hub)
 	go func() {
 		for {
 			hub.broadcast <- Ping{}
@@ -67,7 +195,8 @@ func main() {
 		}
 	}()
 
-	newQueueConsumer(storageConnectionString)
+	consumerCtx, stopConsumer := context.WithCancel(context.Background())
+	newQueueConsumer(consumerCtx, storageConnectionString)
 
 	router := mux.NewRouter().StrictSlash(true)
 	router.HandleFunc("/api/library", getLibraries).Methods(http.MethodGet)
@@ -79,6 +208,13 @@ func main() {
 	router.HandleFunc("/api/media/{key:[0-9]+}/download/persist", deletePersist).Methods(http.MethodDelete)
 	router.HandleFunc("/api/media/{key:[0-9]+}/download/persist", postPersist).Methods(http.MethodPost, http.MethodOptions)
 	router.HandleFunc("/api/media/download/persist/{partition}/{row}", deletePersistForce).Methods(http.MethodDelete)
+	router.HandleFunc("/api/queue", getQueue).Methods(http.MethodGet)
+	router.HandleFunc("/api/queue/{id:[0-9a-f]+}", deleteQueue).Methods(http.MethodDelete)
+	router.HandleFunc("/api/queue/{id:[0-9a-f]+}", patchQueue).Methods(http.MethodPatch, http.MethodOptions)
+	router.HandleFunc("/api/queue/{id:[0-9a-f]+}/bump", postQueueBump).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/api/history", getHistory).Methods(http.MethodGet)
+	router.HandleFunc("/api/bandwidth", getBandwidth).Methods(http.MethodGet)
+	router.HandleFunc("/api/bandwidth", putBandwidth).Methods(http.MethodPut, http.MethodOptions)
 	router.HandleFunc("/api/search", getSearch).Queries("q", "{query}").Methods(http.MethodGet)
 	router.HandleFunc("/api/ws", func(writer http.ResponseWriter, request *http.Request) {
 		ws(writer, request, hub)
@@ -98,32 +234,87 @@ func main() {
 
 	log.Printf("[Main] Starting server on :%v", port)
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
 
 	c := make(chan os.Signal, 1)
-	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
-	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
-	signal.Notify(c, os.Interrupt)
+	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C) or SIGTERM (docker stop)
+	// SIGKILL or SIGQUIT (Ctrl+/) will not be caught.
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	// Block until we receive our signal.
-	<-c
+	sig := <-c
+	log.Printf("[Main] Received %v, shutting down", sig)
 
 	// Create a deadline to wait for.
 	ctx, cancel := context.WithTimeout(context.Background(), wait)
 	defer cancel()
+
+	// Stop taking requests from the webhook queue, then workers finish their current download but don't start another
+	stopConsumer()
+	downloadQueue.Close()
+
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
 	_ = srv.Shutdown(ctx)
-	// Optionally, you could run srv.Shutdown in a goroutine and block on
-	// <-ctx.Done() if your application should wait for other services
-	// to finalize based on context cancellation.
+
+	waitForWorkers(ctx)
+
+	err = downloadQueue.Flush()
+	if err != nil {
+		log.Printf("[Main] Failed to save download queue: %v", err)
+	}
 	log.Println("[Main] Shutting down")
 	os.Exit(0)
 }
 
+// checkpointTimeout is how long workers get to stop once their downloads have been cancelled
+const checkpointTimeout = time.Second * 5
+
+// waitForWorkers lets active downloads finish until the deadline, then checkpoints whatever is still running
+func waitForWorkers(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		workerGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	n := checkpointActive()
+	log.Printf("[Main] Graceful timeout reached, checkpointed %v active downloads", n)
+
+	select {
+	case <-done:
+	case <-time.After(checkpointTimeout):
+		log.Printf("[Main] Workers did not stop within %v", checkpointTimeout)
+	}
+}
+
+func envString(key string, fallback string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+
+	return v
+}
+
+func envInt(key string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+
+	return v
+}
+
 type loggingResponseWriter struct {
 	http.ResponseWriter
 	statusCode int
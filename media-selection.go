@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/oppewala/plex-local-dl/pkg/plex"
+)
+
+var ErrMediaNotFound = errors.New("media version not found")
+
+// selectMedia picks the version of the item to download, either the one requested by id or index, the best match
+// for the default quality rules overridden by those of the request, or the first version plex lists
+func selectMedia(m plex.Metadata, opts DownloadOptions) (plex.Media, error) {
+	if len(m.Media) == 0 {
+		return plex.Media{}, fmt.Errorf("%w: %v has no media", ErrMediaNotFound, m.ConcatTitles())
+	}
+
+	if opts.MediaID != 0 {
+		for _, media := range m.Media {
+			if media.ID == opts.MediaID {
+				return media, nil
+			}
+		}
+		return plex.Media{}, fmt.Errorf("%w: %v has no media with id %v", ErrMediaNotFound, m.ConcatTitles(), opts.MediaID)
+	}
+
+	if opts.MediaIndex != nil {
+		i := *opts.MediaIndex
+		if i < 0 || i >= len(m.Media) {
+			return plex.Media{}, fmt.Errorf("%w: %v has %v media versions, %v requested", ErrMediaNotFound, m.ConcatTitles(), len(m.Media), i)
+		}
+		return m.Media[i], nil
+	}
+
+	rules := defaultQuality.Merge(opts.Quality)
+	if rules.IsZero() {
+		return m.Media[0], nil
+	}
+
+	media, ok := rules.Select(m.Media)
+	if !ok {
+		log.Printf("[API] No media version of %v matches %+v, using the smallest (%v)", m.ConcatTitles(), rules, media.ID)
+	}
+	return media, nil
+}
+
+// parseQuality reads quality rules from the maxResolution, codec, maxBitrate (kbps) and maxSize values
+func parseQuality(get func(string) string) (plex.QualityRules, error) {
+	q := plex.QualityRules{
+		MaxResolution:  get("maxResolution"),
+		PreferredCodec: get("codec"),
+	}
+
+	if v := get("maxBitrate"); v != "" {
+		b, err := strconv.Atoi(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid max bitrate '%v'", v)
+		}
+		q.MaxBitrate = b
+	}
+
+	s, err := parseBytes(get("maxSize"))
+	if err != nil {
+		return q, err
+	}
+	q.MaxSize = s
+
+	return q, nil
+}
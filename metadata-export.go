@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/oppewala/plex-local-dl/pkg/plex"
+)
+
+// nfoMovie and nfoEpisode follow the Kodi nfo format, which Jellyfin, Emby and the local assets agents also read
+type nfoMovie struct {
+	XMLName       xml.Name      `xml:"movie"`
+	Title         string        `xml:"title"`
+	OriginalTitle string        `xml:"originaltitle,omitempty"`
+	SortTitle     string        `xml:"sorttitle,omitempty"`
+	Year          int           `xml:"year,omitempty"`
+	Plot          string        `xml:"plot,omitempty"`
+	Tagline       string        `xml:"tagline,omitempty"`
+	Runtime       int           `xml:"runtime,omitempty"`
+	MPAA          string        `xml:"mpaa,omitempty"`
+	Rating        float64       `xml:"rating,omitempty"`
+	Premiered     string        `xml:"premiered,omitempty"`
+	Studio        string        `xml:"studio,omitempty"`
+	UniqueID      []nfoUniqueID `xml:"uniqueid"`
+	Genre         []string      `xml:"genre"`
+	Country       []string      `xml:"country"`
+	Director      []string      `xml:"director"`
+	Credits       []string      `xml:"credits"`
+	Actor         []nfoActor    `xml:"actor"`
+}
+
+type nfoEpisode struct {
+	XMLName   xml.Name      `xml:"episodedetails"`
+	Title     string        `xml:"title"`
+	ShowTitle string        `xml:"showtitle,omitempty"`
+	Season    int           `xml:"season"`
+	Episode   int           `xml:"episode"`
+	Plot      string        `xml:"plot,omitempty"`
+	Runtime   int           `xml:"runtime,omitempty"`
+	MPAA      string        `xml:"mpaa,omitempty"`
+	Rating    float64       `xml:"rating,omitempty"`
+	Aired     string        `xml:"aired,omitempty"`
+	Studio    string        `xml:"studio,omitempty"`
+	UniqueID  []nfoUniqueID `xml:"uniqueid"`
+	Director  []string      `xml:"director"`
+	Credits   []string      `xml:"credits"`
+	Actor     []nfoActor    `xml:"actor"`
+}
+
+type nfoUniqueID struct {
+	Type    string `xml:"type,attr"`
+	Default bool   `xml:"default,attr,omitempty"`
+	ID      string `xml:",chardata"`
+}
+
+type nfoActor struct {
+	Name  string `xml:"name"`
+	Role  string `xml:"role,omitempty"`
+	Order int    `xml:"order"`
+}
+
+// artwork is an image of the item to save next to the video as <video>-<suffix>.jpg
+type artwork struct {
+	suffix string
+	key    string
+}
+
+// writeMetadata saves an nfo file and the artwork of the item next to the video. Existing files are left alone so
+// edits made locally aren't overwritten.
+func writeMetadata(ctx context.Context, r DownloadRequest, videoPath string) error {
+	m := metadataDetails(ctx, r)
+	base := strings.TrimSuffix(videoPath, filepath.Ext(videoPath))
+
+	var doc interface{}
+	var art []artwork
+	switch m.Type {
+	case "movie":
+		doc = movieNfo(m)
+		art = []artwork{{suffix: "poster", key: m.Thumb}, {suffix: "fanart", key: m.Art}}
+	case "episode":
+		doc = episodeNfo(m)
+		art = []artwork{{suffix: "thumb", key: m.Thumb}}
+	default:
+		return fmt.Errorf("no metadata export for type %v", m.Type)
+	}
+
+	nfoPath := base + ".nfo"
+	if _, err := os.Stat(nfoPath); os.IsNotExist(err) {
+		b, err := xml.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			err = fmt.Errorf("failed to convert metadata to nfo: %w", err)
+			return err
+		}
+
+		log.Printf("[Processor] Writing metadata for %v to %v", r.Title(), nfoPath)
+		err = ioutil.WriteFile(nfoPath, append([]byte(xml.Header), b...), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, a := range art {
+		if a.key == "" {
+			continue
+		}
+
+		path := fmt.Sprintf("%v-%v.jpg", base, a.suffix)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+
+		log.Printf("[Processor] Downloading %v for %v to %v", a.suffix, r.Title(), path)
+		err := downloadFile(ctx, a.key, path)
+		if err != nil {
+			err = fmt.Errorf("failed to download %v %v: %w", a.suffix, a.key, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// metadataDetails returns the metadata of the request, looking the item up again when it came from a child listing
+// that leaves out the cast and crew
+func metadataDetails(ctx context.Context, r DownloadRequest) plex.Metadata {
+	m := r.Metadata
+	if len(m.Role) > 0 || len(m.Director) > 0 || len(m.Genre) > 0 {
+		return m
+	}
+
+	full, err := plexServer.GetMediaMetadata(ctx, m.RatingKey)
+	if err != nil {
+		log.Printf("[Processor] Failed to look up full metadata for %v, exporting what is known: %v", r.Title(), err)
+		return m
+	}
+
+	return full
+}
+
+func movieNfo(m plex.Metadata) nfoMovie {
+	n := nfoMovie{
+		Title:         m.Title,
+		OriginalTitle: m.OriginalTitle,
+		SortTitle:     m.TitleSort,
+		Year:          m.Year,
+		Plot:          m.Summary,
+		Tagline:       m.Tagline,
+		Runtime:       m.Duration / 60000,
+		MPAA:          m.ContentRating,
+		Rating:        nfoRating(m),
+		Premiered:     m.OriginallyAvailableAt,
+		Studio:        m.Studio,
+		UniqueID:      nfoUniqueIDs(m.GUID),
+		Actor:         nfoActors(m.Role),
+	}
+	for _, g := range m.Genre {
+		n.Genre = append(n.Genre, g.Tag)
+	}
+	for _, c := range m.Country {
+		n.Country = append(n.Country, c.Tag)
+	}
+	for _, d := range m.Director {
+		n.Director = append(n.Director, d.Tag)
+	}
+	for _, w := range m.Writer {
+		n.Credits = append(n.Credits, w.Tag)
+	}
+
+	return n
+}
+
+func episodeNfo(m plex.Metadata) nfoEpisode {
+	n := nfoEpisode{
+		Title:     m.Title,
+		ShowTitle: m.GrandparentTitle,
+		Season:    m.ParentIndex,
+		Episode:   m.Index,
+		Plot:      m.Summary,
+		Runtime:   m.Duration / 60000,
+		MPAA:      m.ContentRating,
+		Rating:    nfoRating(m),
+		Aired:     m.OriginallyAvailableAt,
+		Studio:    m.Studio,
+		UniqueID:  nfoUniqueIDs(m.GUID),
+		Actor:     nfoActors(m.Role),
+	}
+	for _, d := range m.Director {
+		n.Director = append(n.Director, d.Tag)
+	}
+	for _, w := range m.Writer {
+		n.Credits = append(n.Credits, w.Tag)
+	}
+
+	return n
+}
+
+func nfoRating(m plex.Metadata) float64 {
+	if m.AudienceRating > 0 {
+		return m.AudienceRating
+	}
+
+	return m.Rating
+}
+
+// nfoUniqueIDs converts plex guids such as imdb://tt0111161 into ids of that type, the first one is the default
+func nfoUniqueIDs(guids []plex.GUID) []nfoUniqueID {
+	ids := make([]nfoUniqueID, 0, len(guids))
+	for _, g := range guids {
+		s := strings.SplitN(g.ID, "://", 2)
+		if len(s) != 2 || s[1] == "" {
+			continue
+		}
+
+		ids = append(ids, nfoUniqueID{Type: s[0], ID: s[1], Default: len(ids) == 0})
+	}
+
+	return ids
+}
+
+func nfoActors(roles []plex.Role) []nfoActor {
+	actors := make([]nfoActor, 0, len(roles))
+	for i, r := range roles {
+		actors = append(actors, nfoActor{Name: r.Tag, Role: r.Role, Order: i})
+	}
+
+	return actors
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PathMapping replaces the Remote prefix of a file on the remote server with Local, an empty Local strips it
+type PathMapping struct {
+	Remote string
+	Local  string
+}
+
+var (
+	pathMappings []PathMapping
+
+	templateField = regexp.MustCompile(`\{([A-Za-z]+)(?::([0-9]+))?\}`)
+	invalidChars  = strings.NewReplacer("/", "-", "\\", "-", ":", " -", "*", "", "?", "", "\"", "'", "<", "", ">", "", "|", "-")
+)
+
+// parsePathMappings reads rules such as "/data/media/mnt/remote/tv=/tv,/data/media/mnt/remote/movies=/movies"
+func parsePathMappings(v string) ([]PathMapping, error) {
+	m := make([]PathMapping, 0)
+	for _, rule := range strings.Split(v, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid path mapping '%v', expected remote=local", rule)
+		}
+		m = append(m, PathMapping{Remote: strings.TrimSpace(parts[0]), Local: strings.TrimSpace(parts[1])})
+	}
+
+	// The most specific prefix wins
+	sort.SliceStable(m, func(i, j int) bool { return len(m[i].Remote) > len(m[j].Remote) })
+
+	return m, nil
+}
+
+// mapPath applies the first mapping whose prefix matches the file
+func mapPath(mappings []PathMapping, file string) string {
+	for _, m := range mappings {
+		if file == m.Remote || strings.HasPrefix(file, strings.TrimSuffix(m.Remote, "/")+"/") {
+			return strings.TrimSuffix(m.Local, "/") + "/" + strings.TrimPrefix(strings.TrimPrefix(file, m.Remote), "/")
+		}
+	}
+
+	return file
+}
+
+// destinationPath builds the local path of a part from the naming template for its type, falling back to the
+// mapped remote path when no template is configured. Transcodes are labelled as an optimized version of the item.
+func destinationPath(r DownloadRequest) string {
+	p := templatePath(r)
+	if r.Transcode == nil {
+		return p
+	}
+
+	return fmt.Sprintf("%v - Optimized %v.mp4", strings.TrimSuffix(p, filepath.Ext(p)), r.Transcode.Name)
+}
+
+func templatePath(r DownloadRequest) string {
+	t := movieTemplate
+	if r.Metadata.Type == "episode" {
+		t = episodeTemplate
+	}
+
+	if t == "" {
+		return filepath.Join(mediaPath, filepath.FromSlash(mapPath(pathMappings, r.Part.File)))
+	}
+
+	p := renderTemplate(t, r)
+
+	// Multi-part media needs a distinct name for each part
+	if r.PartCount > 1 && !strings.Contains(t, "{Part") {
+		ext := path.Ext(p)
+		p = fmt.Sprintf("%v - pt%d%v", strings.TrimSuffix(p, ext), r.PartIndex+1, ext)
+	}
+
+	return filepath.Join(mediaPath, filepath.FromSlash(p))
+}
+
+// renderTemplate replaces fields such as {GrandparentTitle} or {Index:02} with values from the request, a number
+// after the colon zero pads numeric fields to that width
+func renderTemplate(t string, r DownloadRequest) string {
+	m := r.Metadata
+	ext := strings.TrimPrefix(path.Ext(r.Part.File), ".")
+	container := r.Part.Container
+	if container == "" {
+		container = ext
+	}
+
+	values := map[string]interface{}{
+		"Title":            m.Title,
+		"OriginalTitle":    m.OriginalTitle,
+		"ParentTitle":      m.ParentTitle,
+		"GrandparentTitle": m.GrandparentTitle,
+		"Year":             m.Year,
+		"Index":            m.Index,
+		"ParentIndex":      m.ParentIndex,
+		"RatingKey":        m.RatingKey,
+		"Part":             r.PartIndex + 1,
+		"Container":        container,
+		"Extension":        ext,
+	}
+	if len(m.Media) > 0 {
+		values["VideoResolution"] = m.Media[0].VideoResolution
+	}
+
+	return templateField.ReplaceAllStringFunc(t, func(f string) string {
+		match := templateField.FindStringSubmatch(f)
+		v, ok := values[match[1]]
+		if !ok {
+			return f
+		}
+
+		switch v := v.(type) {
+		case int:
+			if match[2] != "" {
+				w, _ := strconv.Atoi(match[2])
+				return fmt.Sprintf("%0*d", w, v)
+			}
+			return strconv.Itoa(v)
+		default:
+			return strings.TrimSpace(invalidChars.Replace(fmt.Sprint(v)))
+		}
+	})
+}
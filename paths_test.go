@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/oppewala/plex-local-dl/pkg/plex"
+)
+
+func TestMapPath(t *testing.T) {
+	mappings, err := parsePathMappings("/data=/all, /data/media/tv=/tv, /data/media/movies/=/movies, /data/media/anime=/anime/, /strip=")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{"most specific prefix wins", "/data/media/tv/Show/S01E01.mkv", "/tv/Show/S01E01.mkv"},
+		{"shorter prefix", "/data/other/file.mkv", "/all/other/file.mkv"},
+		{"trailing slash on remote", "/data/media/movies/Film (2000)/Film.mkv", "/movies/Film (2000)/Film.mkv"},
+		{"trailing slash on local", "/data/media/anime/Show/S01E01.mkv", "/anime/Show/S01E01.mkv"},
+		{"prefix must end at a directory", "/data/media/tvshows/file.mkv", "/all/media/tvshows/file.mkv"},
+		{"empty local strips the prefix", "/strip/file.mkv", "/file.mkv"},
+		{"no match", "/elsewhere/file.mkv", "/elsewhere/file.mkv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mapPath(mappings, tt.file); got != tt.want {
+				t.Errorf("mapPath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePathMappingsInvalid(t *testing.T) {
+	for _, v := range []string{"/remote", "=/local"} {
+		if _, err := parsePathMappings(v); err == nil {
+			t.Errorf("parsePathMappings(%q) succeeded, want an error", v)
+		}
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	episode := DownloadRequest{
+		Metadata: plex.Metadata{
+			Type:             "episode",
+			Title:            "Pilot: Part 1?",
+			GrandparentTitle: "Show/Name",
+			ParentIndex:      1,
+			Index:            3,
+			Year:             2001,
+		},
+		Part: plex.Part{File: "/remote/file.mkv"},
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		r        DownloadRequest
+		want     string
+	}{
+		{"padding", "S{ParentIndex:02}E{Index:03}", episode, "S01E003"},
+		{"no padding", "{ParentIndex}x{Index}", episode, "1x3"},
+		{"padding shorter than value", "{Year:02}", episode, "2001"},
+		{"invalid characters cleaned", "{GrandparentTitle} - {Title}", episode, "Show-Name - Pilot - Part 1"},
+		{"extension as container", "{Title}.{Container}", DownloadRequest{Metadata: plex.Metadata{Title: "Film"}, Part: plex.Part{File: "/a/b.avi"}}, "Film.avi"},
+		{"container from part", "{Container}/{Extension}", DownloadRequest{Part: plex.Part{File: "/a/b.mkv", Container: "matroska"}}, "matroska/mkv"},
+		{"part is one based", "pt{Part}", DownloadRequest{PartIndex: 1}, "pt2"},
+		{"unknown field kept", "{Unknown}", episode, "{Unknown}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderTemplate(tt.template, tt.r); got != tt.want {
+				t.Errorf("renderTemplate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplatePathMultiPart(t *testing.T) {
+	defer func(m string, t string) { mediaPath, movieTemplate = m, t }(mediaPath, movieTemplate)
+	mediaPath = "/media"
+
+	r := DownloadRequest{
+		PartIndex: 1,
+		PartCount: 2,
+		Metadata:  plex.Metadata{Type: "movie", Title: "Film", Year: 2000},
+		Part:      plex.Part{File: "/remote/film.cd2.mkv"},
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"suffix added", "movies/{Title} ({Year}).{Container}", "/media/movies/Film (2000) - pt2.mkv"},
+		{"template names the part", "movies/{Title} ({Year}) - cd{Part}.{Container}", "/media/movies/Film (2000) - cd2.mkv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movieTemplate = tt.template
+			if got := templatePath(r); got != tt.want {
+				t.Errorf("templatePath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	r.PartCount = 1
+	movieTemplate = "movies/{Title}.{Container}"
+	if got, want := templatePath(r), "/media/movies/Film.mkv"; got != want {
+		t.Errorf("templatePath() of a single part = %v, want %v", got, want)
+	}
+}
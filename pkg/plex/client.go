@@ -0,0 +1,84 @@
+package plex
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ClientOptions configure the http.Client shared by every request to a plex server. Only connection level timeouts
+// are set on the client so it can also stream files that take hours to download; API calls are limited by
+// Server.Timeout instead.
+type ClientOptions struct {
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	KeepAlive             time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConnsPerHost   int
+	// Proxy is the url of a proxy to send requests through, HTTP_PROXY and HTTPS_PROXY are used when it is empty
+	Proxy string
+}
+
+// DefaultClientOptions are used for any option left at zero
+var DefaultClientOptions = ClientOptions{
+	DialTimeout:           time.Second * 30,
+	TLSHandshakeTimeout:   time.Second * 10,
+	ResponseHeaderTimeout: time.Second * 30,
+	KeepAlive:             time.Second * 30,
+	IdleConnTimeout:       time.Second * 90,
+	MaxIdleConnsPerHost:   10,
+}
+
+// NewClient creates an http.Client with the options, intended to be created once and shared
+func NewClient(o ClientOptions) (*http.Client, error) {
+	d := DefaultClientOptions
+	if o.DialTimeout == 0 {
+		o.DialTimeout = d.DialTimeout
+	}
+	if o.TLSHandshakeTimeout == 0 {
+		o.TLSHandshakeTimeout = d.TLSHandshakeTimeout
+	}
+	if o.ResponseHeaderTimeout == 0 {
+		o.ResponseHeaderTimeout = d.ResponseHeaderTimeout
+	}
+	if o.KeepAlive == 0 {
+		o.KeepAlive = d.KeepAlive
+	}
+	if o.IdleConnTimeout == 0 {
+		o.IdleConnTimeout = d.IdleConnTimeout
+	}
+	if o.MaxIdleConnsPerHost == 0 {
+		o.MaxIdleConnsPerHost = d.MaxIdleConnsPerHost
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if o.Proxy != "" {
+		u, err := url.Parse(o.Proxy)
+		if err != nil {
+			err = fmt.Errorf("invalid proxy url %v: %w", o.Proxy, err)
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   o.DialTimeout,
+		KeepAlive: o.KeepAlive,
+	}
+	t := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   o.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: o.ResponseHeaderTimeout,
+		IdleConnTimeout:       o.IdleConnTimeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   o.MaxIdleConnsPerHost,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	return &http.Client{Transport: t}, nil
+}
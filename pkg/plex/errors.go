@@ -0,0 +1,72 @@
+package plex
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+var (
+	// ErrUnauthorized means the server rejected the token
+	ErrUnauthorized = errors.New("plex server rejected the token")
+	// ErrNotFound means the requested item or file does not exist on the server
+	ErrNotFound = errors.New("plex item not found")
+	// ErrUnavailable means the server could not be reached or failed to respond, trying again later may work
+	ErrUnavailable = errors.New("plex server unavailable")
+	// ErrUnexpectedStatus covers any other status the server responds with
+	ErrUnexpectedStatus = errors.New("unexpected response from plex server")
+)
+
+// Error is returned when a request to the server fails. errors.Is matches it against its Kind, one of
+// ErrUnauthorized, ErrNotFound, ErrUnavailable or ErrUnexpectedStatus, as well as the underlying error.
+type Error struct {
+	Kind       error
+	StatusCode int // 0 when no response was received or the response was successful but unusable
+	Path       string
+	Err        error
+}
+
+// NewStatusError classifies an unsuccessful response to a request for path
+func NewStatusError(path string, statusCode int) *Error {
+	e := &Error{StatusCode: statusCode, Path: path}
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		e.Kind = ErrUnauthorized
+	case statusCode == http.StatusNotFound:
+		e.Kind = ErrNotFound
+	case statusCode >= 500 || statusCode == http.StatusTooManyRequests || statusCode == http.StatusRequestTimeout:
+		e.Kind = ErrUnavailable
+	default:
+		e.Kind = ErrUnexpectedStatus
+	}
+
+	return e
+}
+
+// NewRequestError wraps a failure to get any response for path. The url is dropped from the error as it holds the
+// token.
+func NewRequestError(path string, err error) *Error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		err = ue.Err
+	}
+
+	return &Error{Kind: ErrUnavailable, Path: path, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%v: %v: %v", e.Kind, e.Path, e.Err)
+	}
+
+	return fmt.Sprintf("%v: %v responded with %v %v", e.Kind, e.Path, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,86 @@
+package plex
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewStatusError(t *testing.T) {
+	tests := []struct {
+		code int
+		want error
+	}{
+		{http.StatusUnauthorized, ErrUnauthorized},
+		{http.StatusForbidden, ErrUnauthorized},
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusRequestTimeout, ErrUnavailable},
+		{http.StatusTooManyRequests, ErrUnavailable},
+		{http.StatusInternalServerError, ErrUnavailable},
+		{http.StatusBadGateway, ErrUnavailable},
+		{http.StatusServiceUnavailable, ErrUnavailable},
+		{http.StatusBadRequest, ErrUnexpectedStatus},
+		{http.StatusTeapot, ErrUnexpectedStatus},
+		{http.StatusMovedPermanently, ErrUnexpectedStatus},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.code), func(t *testing.T) {
+			err := NewStatusError("/library/sections", tt.code)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("NewStatusError(%v) is %v, want %v", tt.code, err.Kind, tt.want)
+			}
+			if !strings.Contains(err.Error(), http.StatusText(tt.code)) {
+				t.Errorf("Error() = %v, want the status in it", err)
+			}
+		})
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/library/metadata/1":
+			_, _ = w.Write([]byte(`{"MediaContainer": {"Metadata": []}}`))
+		case "/library/metadata/2":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	s := NewServer(srv.URL, "SECRET", srv.Client())
+
+	_, err := s.GetMediaMetadata(context.Background(), "1")
+	var pe *Error
+	if !errors.As(err, &pe) || !errors.Is(err, ErrNotFound) {
+		t.Fatalf("empty container = %v, want ErrNotFound", err)
+	}
+	if pe.StatusCode != 0 || strings.Contains(err.Error(), "200") {
+		t.Errorf("empty container = %v, want no status code", err)
+	}
+
+	_, err = s.GetMediaMetadata(context.Background(), "2")
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("401 = %v, want ErrUnauthorized", err)
+	}
+
+	_, err = s.GetMediaMetadata(context.Background(), "3")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("404 = %v, want ErrNotFound", err)
+	}
+
+	// Nothing listens once the server is closed
+	srv.Close()
+	_, err = s.GetMediaMetadata(context.Background(), "1")
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("closed server = %v, want ErrUnavailable", err)
+	}
+	if strings.Contains(err.Error(), "SECRET") {
+		t.Errorf("Error() = %v, leaks the token", err)
+	}
+}
@@ -13,3 +13,18 @@ func (m Metadata) ConcatTitles() string {
 	t += m.Title
 	return t
 }
+
+// StreamTypeSubtitle is the streamType plex uses for subtitles
+const StreamTypeSubtitle = 3
+
+// ExternalSubtitles returns the subtitle streams stored in files next to the part rather than inside it
+func (p Part) ExternalSubtitles() []Stream {
+	s := make([]Stream, 0)
+	for _, st := range p.Stream {
+		if st.StreamType == StreamTypeSubtitle && st.Key != "" {
+			s = append(s, st)
+		}
+	}
+
+	return s
+}
@@ -0,0 +1,128 @@
+package plex
+
+import (
+	"strconv"
+	"strings"
+)
+
+// QualityRules limit which Media version of an item is downloaded, zero values don't apply a limit
+type QualityRules struct {
+	MaxResolution  string `json:",omitempty"` // e.g. 720, 1080 or 4k
+	PreferredCodec string `json:",omitempty"` // e.g. h264 or hevc
+	MaxBitrate     int    `json:",omitempty"` // kbps
+	MaxSize        uint64 `json:",omitempty"` // bytes, across all parts
+}
+
+// Merge returns the rules with any values set in o replacing its own
+func (q QualityRules) Merge(o QualityRules) QualityRules {
+	if o.MaxResolution != "" {
+		q.MaxResolution = o.MaxResolution
+	}
+	if o.PreferredCodec != "" {
+		q.PreferredCodec = o.PreferredCodec
+	}
+	if o.MaxBitrate != 0 {
+		q.MaxBitrate = o.MaxBitrate
+	}
+	if o.MaxSize != 0 {
+		q.MaxSize = o.MaxSize
+	}
+
+	return q
+}
+
+// IsZero is true when no rule is set
+func (q QualityRules) IsZero() bool {
+	return q == QualityRules{}
+}
+
+// Select picks the best version within the limits, preferring the codec, then the highest resolution and bitrate.
+// When no version fits the smallest one is returned and ok is false.
+func (q QualityRules) Select(media []Media) (m Media, ok bool) {
+	if len(media) == 0 {
+		return Media{}, false
+	}
+
+	best := -1
+	for i, v := range media {
+		if !q.allows(v) {
+			continue
+		}
+		if best < 0 || q.better(v, media[best]) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		return media[best], true
+	}
+
+	smallest := 0
+	for i, v := range media {
+		if v.Size() < media[smallest].Size() {
+			smallest = i
+		}
+	}
+	return media[smallest], false
+}
+
+func (q QualityRules) allows(m Media) bool {
+	if q.MaxResolution != "" && ResolutionHeight(m.VideoResolution) > ResolutionHeight(q.MaxResolution) {
+		return false
+	}
+	if q.MaxBitrate > 0 && m.Bitrate > q.MaxBitrate {
+		return false
+	}
+	if q.MaxSize > 0 && m.Size() > q.MaxSize {
+		return false
+	}
+
+	return true
+}
+
+func (q QualityRules) better(a Media, b Media) bool {
+	if q.PreferredCodec != "" {
+		ac := strings.EqualFold(a.VideoCodec, q.PreferredCodec)
+		bc := strings.EqualFold(b.VideoCodec, q.PreferredCodec)
+		if ac != bc {
+			return ac
+		}
+	}
+
+	ah, bh := ResolutionHeight(a.VideoResolution), ResolutionHeight(b.VideoResolution)
+	if ah != bh {
+		return ah > bh
+	}
+
+	return a.Bitrate > b.Bitrate
+}
+
+// Size is the total size of the parts of the media
+func (m Media) Size() uint64 {
+	var s uint64
+	for _, p := range m.Part {
+		s += p.Size
+	}
+
+	return s
+}
+
+// ResolutionHeight converts a plex videoResolution such as "1080", "4k" or "sd" into a line count for comparisons
+func ResolutionHeight(r string) int {
+	r = strings.ToLower(strings.TrimSuffix(strings.ToLower(r), "p"))
+	switch r {
+	case "":
+		return 0
+	case "sd":
+		return 480
+	case "4k", "uhd":
+		return 2160
+	case "8k":
+		return 4320
+	}
+
+	h, err := strconv.Atoi(r)
+	if err != nil {
+		return 0
+	}
+	return h
+}
@@ -0,0 +1,61 @@
+package plex
+
+import "testing"
+
+func TestQualityRulesSelect(t *testing.T) {
+	uhd := Media{ID: 1, VideoResolution: "4k", VideoCodec: "hevc", Bitrate: 40000, Part: []Part{{Size: 40 << 30}}}
+	fhdHevc := Media{ID: 2, VideoResolution: "1080", VideoCodec: "hevc", Bitrate: 6000, Part: []Part{{Size: 6 << 30}}}
+	fhd := Media{ID: 3, VideoResolution: "1080", VideoCodec: "h264", Bitrate: 10000, Part: []Part{{Size: 5 << 30}, {Size: 5 << 30}}}
+	hd := Media{ID: 4, VideoResolution: "720", VideoCodec: "h264", Bitrate: 4000, Part: []Part{{Size: 3 << 30}}}
+	sd := Media{ID: 5, VideoResolution: "sd", VideoCodec: "h264", Bitrate: 1500, Part: []Part{{Size: 1 << 30}}}
+	all := []Media{hd, uhd, sd, fhd, fhdHevc}
+
+	tests := []struct {
+		name   string
+		rules  QualityRules
+		media  []Media
+		wantID int
+		wantOk bool
+	}{
+		{"no rules picks the highest resolution", QualityRules{}, all, uhd.ID, true},
+		{"max resolution", QualityRules{MaxResolution: "1080p"}, all, fhd.ID, true},
+		{"higher bitrate wins at the same resolution", QualityRules{MaxResolution: "1080"}, []Media{fhdHevc, fhd}, fhd.ID, true},
+		{"preferred codec wins over bitrate", QualityRules{MaxResolution: "1080", PreferredCodec: "HEVC"}, all, fhdHevc.ID, true},
+		{"preferred codec wins over resolution", QualityRules{PreferredCodec: "h264"}, all, fhd.ID, true},
+		{"max bitrate", QualityRules{MaxBitrate: 5000}, all, hd.ID, true},
+		{"max size across parts", QualityRules{MaxSize: 8 << 30}, all, fhdHevc.ID, true},
+		{"sd resolution limit", QualityRules{MaxResolution: "sd"}, all, sd.ID, true},
+		{"nothing fits returns the smallest", QualityRules{MaxSize: 1 << 20}, all, sd.ID, false},
+		{"single version", QualityRules{MaxResolution: "720"}, []Media{hd}, hd.ID, true},
+		{"no versions", QualityRules{}, nil, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.rules.Select(tt.media)
+			if got.ID != tt.wantID || ok != tt.wantOk {
+				t.Errorf("Select() = %v, %v, want %v, %v", got.ID, ok, tt.wantID, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestResolutionHeight(t *testing.T) {
+	tests := map[string]int{
+		"":      0,
+		"sd":    480,
+		"480":   480,
+		"720p":  720,
+		"1080":  1080,
+		"4K":    2160,
+		"uhd":   2160,
+		"8k":    4320,
+		"bogus": 0,
+	}
+
+	for r, want := range tests {
+		if got := ResolutionHeight(r); got != want {
+			t.Errorf("ResolutionHeight(%q) = %v, want %v", r, got, want)
+		}
+	}
+}
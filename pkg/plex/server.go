@@ -1,51 +1,89 @@
 package plex
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
+	"time"
 )
 
+// DefaultTimeout limits how long a single API call to the server can take, including reading the response
+const DefaultTimeout = time.Minute
+
 type Server struct {
-	URL   string
-	Token string
+	URL     string
+	Token   string
+	Client  *http.Client
+	Timeout time.Duration
 }
 
-func NewServer(url string, token string) *Server {
+// NewServer creates a server that sends its requests through client, which should be shared between servers and
+// calls so connections are reused. http.DefaultClient is used when client is nil.
+func NewServer(url string, token string, client *http.Client) *Server {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
 	s := &Server{
-		URL:   url,
-		Token: token,
+		URL:     url,
+		Token:   token,
+		Client:  client,
+		Timeout: DefaultTimeout,
 	}
 
 	return s
 }
 
-func (s *Server) executeGet(path string) ([]byte, error) {
+func (s *Server) executeGet(ctx context.Context, path string) ([]byte, error) {
 	log.Printf("[Plex] Executing: %v", path)
 
-	u := fmt.Sprintf("%v%v?X-Plex-Token=%v", s.URL, path, s.Token)
-	req, _ := http.NewRequest("GET", u, nil)
-	req.Header.Add("Accept", "application/json")
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
 
-	client := &http.Client{}
-	res, err := client.Do(req)
-	if err != nil || res.StatusCode != http.StatusOK {
-		err = fmt.Errorf("Failed to execute GET on %v (%v - %v)\n%w", path, u, res.StatusCode, err)
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	u := fmt.Sprintf("%v%v%vX-Plex-Token=%v", s.URL, path, sep, s.Token)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
 		return nil, err
 	}
+	req.Header.Add("Accept", "application/json")
 
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return nil, NewRequestError(path, err)
+	}
 	defer func(Body io.ReadCloser) {
 		_ = Body.Close()
 	}(res.Body)
-	return ioutil.ReadAll(res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return nil, NewStatusError(path, res.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, NewRequestError(path, err)
+	}
+
+	return b, nil
 }
 
-func (s *Server) GetLibraries() ([]Directory, error) {
-	body, err := s.executeGet("/library/sections")
+func (s *Server) GetLibraries(ctx context.Context) ([]Directory, error) {
+	body, err := s.executeGet(ctx, "/library/sections")
 	if err != nil {
 		return nil, err
 	}
@@ -61,8 +99,8 @@ func (s *Server) GetLibraries() ([]Directory, error) {
 	return l.MediaContainer.Directory, nil
 }
 
-func (s *Server) GetLibraryContent(key string) ([]Metadata, error) {
-	body, err := s.executeGet(fmt.Sprintf("/library/sections/%s/all", key))
+func (s *Server) GetLibraryContent(ctx context.Context, key string) ([]Metadata, error) {
+	body, err := s.executeGet(ctx, fmt.Sprintf("/library/sections/%s/all", key))
 	if err != nil {
 		return nil, err
 	}
@@ -78,11 +116,11 @@ func (s *Server) GetLibraryContent(key string) ([]Metadata, error) {
 	return l.MediaContainer.Metadata, nil
 }
 
-func (s *Server) GetMediaMetadata(key string) (Metadata, error) {
+func (s *Server) GetMediaMetadata(ctx context.Context, key string) (Metadata, error) {
 	// TODO: Cache this method
 
 	rootRequest := fmt.Sprintf("/library/metadata/%s", key)
-	body, err := s.executeGet(rootRequest)
+	body, err := s.executeGet(ctx, rootRequest)
 	if err != nil {
 		err = fmt.Errorf("failed to get root metadata: %w", err)
 		return Metadata{}, err
@@ -95,13 +133,16 @@ func (s *Server) GetMediaMetadata(key string) (Metadata, error) {
 		err = fmt.Errorf("failed to convert body from json \n%w", err)
 		return Metadata{}, err
 	}
+	if len(l.MediaContainer.Metadata) == 0 {
+		return Metadata{}, &Error{Kind: ErrNotFound, Path: rootRequest, Err: errors.New("response contained no metadata")}
+	}
 
 	return l.MediaContainer.Metadata[0], nil
 }
 
-func (s *Server) GetMediaMetadataChildren(key string) ([]Metadata, error) {
+func (s *Server) GetMediaMetadataChildren(ctx context.Context, key string) ([]Metadata, error) {
 	rootRequest := fmt.Sprintf("/library/metadata/%s/children", key)
-	body, err := s.executeGet(rootRequest)
+	body, err := s.executeGet(ctx, rootRequest)
 	if err != nil {
 		err = fmt.Errorf("failed to get root metadata: %w", err)
 		return nil, err
@@ -118,8 +159,8 @@ func (s *Server) GetMediaMetadataChildren(key string) ([]Metadata, error) {
 	return l.MediaContainer.Metadata, nil
 }
 
-func (s *Server) GetMetadataWithParts(key string) ([]Metadata, error) {
-	m, err := s.GetMediaMetadata(key)
+func (s *Server) GetMetadataWithParts(ctx context.Context, key string) ([]Metadata, error) {
+	m, err := s.GetMediaMetadata(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -134,7 +175,7 @@ func (s *Server) GetMetadataWithParts(key string) ([]Metadata, error) {
 		meta = append(meta, m)
 		return meta, nil
 	case "show":
-		seasons, err = s.GetMediaMetadataChildren(key)
+		seasons, err = s.GetMediaMetadataChildren(ctx, key)
 		if err != nil {
 			err = fmt.Errorf("failed while retrieving child metadata for show with key %s: %w", key, err)
 			return nil, err
@@ -148,7 +189,7 @@ func (s *Server) GetMetadataWithParts(key string) ([]Metadata, error) {
 	}
 
 	for _, season := range seasons {
-		episodes, err := s.GetMediaMetadataChildren(season.RatingKey)
+		episodes, err := s.GetMediaMetadataChildren(ctx, season.RatingKey)
 		if err != nil {
 			err = fmt.Errorf("failed while retrieving child metadata for season with key %s: %w", season.RatingKey, err)
 			return nil, err
@@ -160,6 +201,17 @@ func (s *Server) GetMetadataWithParts(key string) ([]Metadata, error) {
 	return meta, err
 }
 
+// RefreshSection starts a partial scan of the library section, limited to the directory at path
+func (s *Server) RefreshSection(ctx context.Context, key string, path string) error {
+	_, err := s.executeGet(ctx, fmt.Sprintf("/library/sections/%s/refresh?path=%s", key, url.QueryEscape(path)))
+	if err != nil {
+		err = fmt.Errorf("failed to refresh section %s for %s: %w", key, path, err)
+		return err
+	}
+
+	return nil
+}
+
 func (s *Server) GetDbId(m Metadata) (string, error) {
 	r := regexp.MustCompile("^com\\.plexapp\\.agents\\.thetvdb://(?P<id>[0-9]+)")
 	if r.MatchString(m.Guid) {
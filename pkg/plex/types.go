@@ -50,16 +50,32 @@ type Genre struct {
 	Tag string `json:"tag"`
 }
 type Role struct {
-	Tag string `json:"tag"`
+	Tag   string `json:"tag"`
+	Role  string `json:"role,omitempty"`
+	Thumb string `json:"thumb,omitempty"`
 }
-type Part struct {
+type Stream struct {
 	ID           int    `json:"id"`
-	Key          string `json:"key"`
-	Duration     int    `json:"duration"`
-	File         string `json:"file"`
-	Size         uint64 `json:"size"`
-	Container    string `json:"container"`
-	VideoProfile string `json:"videoProfile"`
+	StreamType   int    `json:"streamType"`
+	Key          string `json:"key,omitempty"`
+	Codec        string `json:"codec"`
+	Format       string `json:"format,omitempty"`
+	Language     string `json:"language,omitempty"`
+	LanguageCode string `json:"languageCode,omitempty"`
+	LanguageTag  string `json:"languageTag,omitempty"`
+	Forced       bool   `json:"forced,omitempty"`
+	Title        string `json:"title,omitempty"`
+	DisplayTitle string `json:"displayTitle"`
+}
+type Part struct {
+	ID           int      `json:"id"`
+	Key          string   `json:"key"`
+	Duration     int      `json:"duration"`
+	File         string   `json:"file"`
+	Size         uint64   `json:"size"`
+	Container    string   `json:"container"`
+	VideoProfile string   `json:"videoProfile"`
+	Stream       []Stream `json:"Stream,omitempty"`
 }
 type Media struct {
 	ID              int     `json:"id"`
@@ -5,8 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	//"github.com/oppewala/plex-local-dl/pkg/plex"
+
 	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	"github.com/oppewala/plex-local-dl/pkg/plex"
 	//"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 )
 
@@ -19,6 +20,7 @@ type Entry struct {
 	DBId     string
 	Title    string
 	PlexKey  uint
+	Quality  plex.QualityRules
 }
 
 type DuplicateEntryError struct {
@@ -69,6 +71,10 @@ func (s *Storage) Add(entry Entry) error {
 			"PlexKey": entry.PlexKey,
 		},
 	}
+	if !entry.Quality.IsZero() {
+		q, _ := json.Marshal(entry.Quality)
+		e.Properties["Quality"] = string(q)
+	}
 	j, err := json.Marshal(e)
 	if err != nil {
 		err = fmt.Errorf("failed to marshal entity: %w", err)
@@ -80,6 +86,28 @@ func (s *Storage) Add(entry Entry) error {
 	return err
 }
 
+// SetQuality replaces the quality rules used when downloading new releases of an existing entry
+func (s *Storage) SetQuality(category string, dbid string, quality plex.QualityRules) error {
+	q, _ := json.Marshal(quality)
+	e := aztables.EDMEntity{
+		Entity: aztables.Entity{
+			PartitionKey: category,
+			RowKey:       dbid,
+		},
+		Properties: map[string]interface{}{
+			"Quality": string(q),
+		},
+	}
+	j, err := json.Marshal(e)
+	if err != nil {
+		err = fmt.Errorf("failed to marshal entity: %w", err)
+		return err
+	}
+
+	_, err = s.client.UpdateEntity(context.TODO(), j, &aztables.UpdateEntityOptions{UpdateMode: aztables.MergeEntity})
+	return err
+}
+
 func (s *Storage) Exists(category string, dbid string) (bool, error) {
 	_, err := s.client.GetEntity(context.TODO(), category, dbid, nil)
 	if err == nil {
@@ -140,6 +168,7 @@ func (s *Storage) Get(category string, dbid string) (Entry, error) {
 		DBId:     entity.RowKey,
 		Title:    entity.Properties["Title"].(string),
 		PlexKey:  entity.Properties["PlexKey"].(uint),
+		Quality:  quality(entity),
 	}, nil
 }
 
@@ -171,9 +200,22 @@ func (s *Storage) List() ([]Entry, error) {
 				DBId:     entity.RowKey,
 				Title:    entity.Properties["Title"].(string),
 				PlexKey:  entity.Properties["PlexKey"].(uint),
+				Quality:  quality(entity),
 			})
 		}
 	}
 
 	return entries, nil
 }
+
+// quality reads the rules stored as json on the entity, entries without rules use the defaults
+func quality(entity aztables.EDMEntity) plex.QualityRules {
+	var q plex.QualityRules
+	if v, ok := entity.Properties["Quality"].(string); ok {
+		if err := json.Unmarshal([]byte(v), &q); err != nil {
+			log.Printf("[Storage] Ignoring invalid quality rules on '%v' '%v': %v", entity.PartitionKey, entity.RowKey, err)
+		}
+	}
+
+	return q
+}
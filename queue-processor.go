@@ -1,40 +1,94 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/oppewala/plex-local-dl/pkg/plex"
 )
 
-var requestQueue = make(chan DownloadRequest)
-
 type DownloadRequest struct {
-	Metadata plex.Metadata
-	Part     plex.Part
+	ID          string
+	State       string
+	Priority    int
+	EnqueuedAt  time.Time
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	Force       bool
+	MediaID     int
+	PartIndex   int
+	PartCount   int
+	Transcode   *TranscodeProfile
+	Metadata    plex.Metadata
+	Part        plex.Part
 }
 
 type DownloadUpdate struct {
 	MessageType     string
+	ID              string
+	RatingKey       string
+	Worker          int
 	Title           string
 	BytesDownloaded uint64
 	TotalBytes      uint64
+	Speed           uint64 `json:",omitempty"` // bytes per second
+	ETA             int64  `json:",omitempty"` // seconds
+	QueuePosition   int    `json:",omitempty"`
+}
+
+type WorkerUpdate struct {
+	MessageType string
+	Worker      int
+	State       string
+	Title       string
 }
 
 type DownloadTracker struct {
+	ID            string
+	RatingKey     string
+	Worker        int
 	Title         string
 	Key           string
 	Total         uint64
 	ExpectedTotal uint64
+	Offset        uint64 // already on disk when the attempt started
 	NextUpdate    time.Time
 	StartTime     time.Time
 	Hub           *Hub
+
+	// Segmented downloads write through the tracker concurrently
+	mu sync.Mutex
+
+	lastUpdate time.Time
+	lastTotal  uint64
+	speed      float64
+}
+
+// speedSmoothing is the weight of the latest sample in the moving average of the transfer rate
+const speedSmoothing = 0.3
+
+// Title names the item being downloaded, including which part it is when the media is split into several files
+func (r DownloadRequest) Title() string {
+	t := r.Metadata.ConcatTitles()
+	if r.PartCount > 1 {
+		t += fmt.Sprintf(" (part %d of %d)", r.PartIndex+1, r.PartCount)
+	}
+	if r.Transcode != nil {
+		t += fmt.Sprintf(" [optimized %v]", r.Transcode.Name)
+	}
+
+	return t
 }
 
 func (u *DownloadUpdate) ToBytes() []byte {
@@ -43,42 +97,238 @@ func (u *DownloadUpdate) ToBytes() []byte {
 	return j
 }
 
+func (u *WorkerUpdate) ToBytes() []byte {
+	j, _ := json.Marshal(u)
+
+	return j
+}
+
 func (wc *DownloadTracker) Write(p []byte) (int, error) {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
 	n := len(p)
 	wc.Total += uint64(n)
 
-	if time.Now().After(wc.NextUpdate) {
+	now := time.Now()
+	if now.After(wc.NextUpdate) {
+		wc.updateSpeed(now)
+
 		update := &DownloadUpdate{
 			MessageType:     "download-update",
+			ID:              wc.ID,
+			RatingKey:       wc.RatingKey,
+			Worker:          wc.Worker,
 			Title:           wc.Title,
 			BytesDownloaded: wc.Total,
 			TotalBytes:      wc.ExpectedTotal,
+			Speed:           uint64(wc.speed),
+			ETA:             wc.eta(),
 		}
 		wc.Hub.broadcast <- update
 
-		wc.NextUpdate = time.Now().Add(time.Second)
+		wc.NextUpdate = now.Add(time.Second)
 	}
 
 	return n, nil
 }
 
-func chanConsumer(hub *Hub) {
+// updateSpeed folds the rate since the previous update into an exponential moving average, so a single slow or
+// fast second doesn't make the speed and ETA jump around
+func (wc *DownloadTracker) updateSpeed(now time.Time) {
+	if wc.lastUpdate.IsZero() {
+		wc.lastUpdate, wc.lastTotal = now, wc.Total
+		return
+	}
+
+	elapsed := now.Sub(wc.lastUpdate).Seconds()
+	if elapsed <= 0 || wc.Total < wc.lastTotal {
+		wc.lastUpdate, wc.lastTotal = now, wc.Total
+		return
+	}
+
+	rate := float64(wc.Total-wc.lastTotal) / elapsed
+	if wc.speed == 0 {
+		wc.speed = rate
+	} else {
+		wc.speed = speedSmoothing*rate + (1-speedSmoothing)*wc.speed
+	}
+	wc.lastUpdate, wc.lastTotal = now, wc.Total
+}
+
+// eta is the number of seconds left at the current speed, 0 when it can't be estimated
+func (wc *DownloadTracker) eta() int64 {
+	if wc.speed < 1 || wc.ExpectedTotal <= wc.Total {
+		return 0
+	}
+
+	return int64(float64(wc.ExpectedTotal-wc.Total) / wc.speed)
+}
+
+// Transferred is the number of bytes received during this attempt
+func (wc *DownloadTracker) Transferred() uint64 {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	if wc.Total < wc.Offset {
+		return 0
+	}
+	return wc.Total - wc.Offset
+}
+
+// workerGroup tracks the running workers so shutdown can wait for their downloads
+var workerGroup sync.WaitGroup
+
+func startWorkers(n int, hub *Hub) {
+	log.Printf("[Processor] Starting %v download workers", n)
+	for i := 1; i <= n; i++ {
+		workerGroup.Add(1)
+		go chanConsumer(i, hub)
+	}
+}
+
+func chanConsumer(worker int, hub *Hub) {
+	defer workerGroup.Done()
+
 	for {
-		r := <-requestQueue
-		log.Printf("[Processor] Message Consumed: %v", r)
+		hub.broadcast <- &WorkerUpdate{MessageType: "worker-update", Worker: worker, State: "idle"}
+
+		r, ok := downloadQueue.Next()
+		if !ok {
+			log.Printf("[Processor][%v] Queue closed, stopping worker", worker)
+			return
+		}
+		log.Printf("[Processor][%v] Message Consumed: %v", worker, r)
+		hub.broadcast <- &WorkerUpdate{MessageType: "worker-update", Worker: worker, State: "downloading", Title: r.Title()}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if !startActive(r.ID, cancel) {
+			log.Printf("[Processor][%v] Skipping %v, no longer queued", worker, r.Title())
+			cancel()
+			continue
+		}
+
+		counter := &DownloadTracker{
+			ID:            r.ID,
+			RatingKey:     r.Metadata.RatingKey,
+			Worker:        worker,
+			Title:         r.Title(),
+			Key:           r.Part.Key,
+			ExpectedTotal: expectedSize(r),
+			StartTime:     time.Now(),
+			Hub:           hub,
+		}
 
-		err := downloadMedia(r, hub)
+		err := downloadMedia(ctx, r, counter)
+		reason := stopActive(r.ID)
+		cancel()
+
+		if reason != "" {
+			log.Printf("[Processor][%v] Download of %v stopped: %v", worker, r.Title(), reason)
+			if reason == StateCancelled {
+				removeTemp(r)
+				history.Record(r, StateCancelled, counter, nil)
+			}
+			setState(r, reason)
+			continue
+		}
+		if errors.Is(err, ErrAlreadyDownloaded) {
+			setState(r, StateDone)
+			log.Printf("[Processor][%v] Skipped, already downloaded: %v", worker, r.Title())
+			scanner.Settle(r, existingPath(r))
+			continue
+		}
+		var spaceErr *InsufficientSpaceError
+		if errors.As(err, &spaceErr) {
+			waitForSpace(r, err)
+			continue
+		}
 		if err != nil {
-			log.Printf("[Processor] Failed to download %v: %v", r.Metadata.ConcatTitles(), err)
+			log.Printf("[Processor][%v] Failed to download %v: %v", worker, r.Title(), err)
+			if failDownload(r, err) {
+				history.Record(r, StateFailed, counter, err)
+			}
 			continue
 		}
 
-		log.Printf("[Processor] Downloaded succesfully: %v", r.Metadata.ConcatTitles())
+		setState(r, StateDone)
+		log.Printf("[Processor][%v] Downloaded succesfully: %v", worker, r.Title())
+		// A move hook changes where the file ends up, which is what gets recorded and scanned
+		path := hooks.Run(HookDownloadComplete, r, nil)
+		history.RecordAt(r, StateDone, path, counter, nil)
+		scanner.Notify(r, path)
+	}
+}
+
+func setState(r DownloadRequest, state string) {
+	r, err := downloadQueue.Transition(r.ID, state)
+	if err != nil {
+		log.Printf("[Processor] Failed to mark %v (%v) as %v: %v", r.Title(), r.ID, state, err)
+		return
+	}
+
+	broadcastState(r)
+}
+
+// downloadPath is the local path the part of the request is written to
+func downloadPath(r DownloadRequest) string {
+	return destinationPath(r)
+}
+
+// existingPath is where a finished download of the request is found, following any move by a hook since
+func existingPath(r DownloadRequest) string {
+	path := downloadPath(r)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	if moved := history.MovedTo(path); moved != "" {
+		return moved
+	}
+
+	return path
+}
+
+// partRequest creates a request for a file on the remote server
+func partRequest(ctx context.Context, key string) (*http.Request, error) {
+	return http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%v%v?X-Plex-Token=%v", plexUrl, key, plexToken), nil)
+}
+
+// redactToken hides the plex token in text that leaves the process, in case an error still carries a request url
+func redactToken(s string) string {
+	if plexToken == "" {
+		return s
 	}
+
+	return strings.ReplaceAll(s, plexToken, "<token>")
 }
 
-func downloadMedia(r DownloadRequest, hub *Hub) error {
-	path := fmt.Sprintf("%s%s", mediaPath, r.Part.File)
+func downloadMedia(ctx context.Context, r DownloadRequest, counter *DownloadTracker) error {
+	path := downloadPath(r)
+	worker, hub := counter.Worker, counter.Hub
+
+	if !r.Force {
+		existing := existingPath(r)
+		match, err := localCopyMatches(ctx, r, existing)
+		if err != nil {
+			return err
+		}
+		if match {
+			log.Printf("[Processor] %v already exists at %v, skipping", r.Title(), existing)
+			fetchSubtitles(ctx, r, existing)
+			fetchMetadata(ctx, r, existing)
+			hub.broadcast <- &DownloadUpdate{
+				MessageType:     "download-skipped",
+				ID:              r.ID,
+				RatingKey:       r.Metadata.RatingKey,
+				Worker:          worker,
+				Title:           r.Title(),
+				BytesDownloaded: r.Part.Size,
+				TotalBytes:      r.Part.Size,
+			}
+			return ErrAlreadyDownloaded
+		}
+	}
+
 	log.Printf("[Processor] Downloading %s from %v to %v", r.Metadata.Title, r.Part.Key, path)
 
 	log.Printf("[Processor] Creating directory: %v", filepath.Dir(path))
@@ -87,42 +337,186 @@ func downloadMedia(r DownloadRequest, hub *Hub) error {
 		return err
 	}
 
-	log.Printf("[Processor] Creating temp file: %v", path+".tmp")
-	file, err := os.Create(path + ".tmp")
+	err = reserveSpace(r, path)
+	if err != nil {
+		return err
+	}
+	defer func() { releaseSpace(r.ID, counter.Transferred()) }()
+
+	// Only now is it certain something will be written, skipped requests and those waiting for space never start
+	hooks.Run(HookDownloadStart, r, nil)
+
+	tmpPath := path + ".tmp"
+	var offset uint64
+	// Transcodes can't be resumed as the output differs between sessions
+	if fi, err := os.Stat(tmpPath); err == nil && r.Transcode == nil && fi.Size() > 0 {
+		size := uint64(fi.Size())
+		if size == r.Part.Size {
+			// The previous run wrote the whole part but was stopped before the rename
+			log.Printf("[Processor] Found complete temp file, verifying: %v", tmpPath)
+			err := verifyDownload(r, tmpPath, size)
+			if err == nil {
+				counter.Offset = size
+				counter.Total = size
+				return finishDownload(ctx, r, counter, tmpPath, path)
+			}
+			log.Printf("[Processor] Complete temp file failed verification, downloading again: %v", err)
+		}
+		if size < r.Part.Size {
+			offset = size
+		}
+	}
+
+	// Resumed downloads continue as a single stream
+	segmented := false
+	if segments > 1 && offset == 0 && r.Transcode == nil && r.Part.Size >= minSegmentSize*2 {
+		segmented, err = supportsRanges(ctx, r.Part.Key)
+		if err != nil {
+			return err
+		}
+		if !segmented {
+			log.Printf("[Processor] Server does not support range requests, downloading as a single stream")
+		}
+	}
+
+	// Segments are written out of order, so they use a temp file of their own that is never mistaken for a
+	// complete or resumable stream. It is resumed from the progress saved next to it.
+	if segmented {
+		tmpPath = segmentsTempPath(path)
+	} else {
+		_ = os.Remove(segmentsTempPath(path))
+		_ = os.Remove(segmentsProgressPath(path))
+	}
+
+	log.Printf("[Processor] Opening temp file: %v", tmpPath)
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	log.Printf("[Processor] Creating request")
-	res, err := http.Get(fmt.Sprintf("%v%v?X-Plex-Token=%v", plexUrl, r.Part.Key, plexToken))
+	if segmented {
+		err = downloadSegments(ctx, file, r, counter)
+	} else {
+		err = downloadStream(ctx, file, r, offset, counter)
+	}
 	if err != nil {
+		if r.Transcode != nil {
+			stopTranscode(r)
+		}
 		return err
 	}
-	defer res.Body.Close()
 
-	log.Printf("[Processor] Starting write")
-	counter := &DownloadTracker{
-		Title:         r.Metadata.ConcatTitles(),
-		Key:           r.Part.Key,
-		ExpectedTotal: r.Part.Size,
-		StartTime:     time.Now(),
-		Hub:           hub,
-	}
-	_, err = io.Copy(file, io.TeeReader(res.Body, counter))
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[Processor] Verifying download: %v", tmpPath)
+	err = verifyDownload(r, tmpPath, counter.Total)
+	if err != nil {
+		return err
+	}
+
+	return finishDownload(ctx, r, counter, tmpPath, path)
+}
+
+// finishDownload moves a verified temp file into place and fetches the files that go alongside it
+func finishDownload(ctx context.Context, r DownloadRequest, counter *DownloadTracker, tmpPath string, path string) error {
+	log.Printf("[Processor] Renaming to final path: %v", path)
+	err := os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+
+	fetchSubtitles(ctx, r, path)
+	fetchMetadata(ctx, r, path)
+
+	counter.Hub.broadcast <- &DownloadUpdate{
+		MessageType:     "download-complete",
+		ID:              r.ID,
+		RatingKey:       r.Metadata.RatingKey,
+		Worker:          counter.Worker,
+		Title:           r.Title(),
+		BytesDownloaded: counter.Total,
+		TotalBytes:      counter.Total,
+	}
+
+	return nil
+}
+
+// fetchSubtitles downloads the external subtitles of the part when enabled, a failure doesn't fail the video
+func fetchSubtitles(ctx context.Context, r DownloadRequest, path string) {
+	if !subtitles {
+		return
+	}
+
+	err := downloadSubtitles(ctx, r, path)
+	if err != nil {
+		log.Printf("[Processor] Failed to download subtitles for %v: %v", r.Title(), err)
+	}
+}
+
+// fetchMetadata writes the nfo and artwork of the item when enabled, a failure doesn't fail the video
+func fetchMetadata(ctx context.Context, r DownloadRequest, path string) {
+	if !exportMetadata || r.PartIndex > 0 {
+		return
+	}
+
+	err := writeMetadata(ctx, r, path)
+	if err != nil {
+		log.Printf("[Processor] Failed to export metadata for %v: %v", r.Title(), err)
+	}
+}
+
+// downloadStream writes the part to file with a single request, continuing from offset when the server allows it
+func downloadStream(ctx context.Context, file *os.File, r DownloadRequest, offset uint64, counter *DownloadTracker) error {
+	log.Printf("[Processor] Creating request")
+	var req *http.Request
+	var err error
+	if r.Transcode != nil {
+		log.Printf("[Processor] Requesting %v transcode (%v, %v kbps)", r.Transcode.Name, r.Transcode.Resolution, r.Transcode.Bitrate)
+		req, err = transcodeRequest(ctx, r)
+	} else {
+		req, err = partRequest(ctx, r.Part.Key)
+	}
 	if err != nil {
 		return err
 	}
+	if offset > 0 {
+		log.Printf("[Processor] Resuming from byte %v of %v", offset, r.Part.Size)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	res, err := plexClient.Do(req)
+	if err != nil {
+		return plex.NewRequestError(r.Part.Key, err)
+	}
+	defer res.Body.Close()
 
-	log.Printf("[Processor] Closing file and renaming to final path: %v", path)
-	file.Close()
-	err = os.Rename(path+".tmp", path)
+	// Checked before anything is truncated, so an error response never costs the partial file
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		return plex.NewStatusError(r.Part.Key, res.StatusCode)
+	}
 
-	hub.broadcast <- &DownloadUpdate{
-		MessageType: "download-complete",
-		Title:       r.Metadata.ConcatTitles(),
+	// Servers that ignore the range send the whole part back, so start again from the beginning
+	if offset > 0 && res.StatusCode != http.StatusPartialContent {
+		log.Printf("[Processor] Server ignored range request (%v), restarting download", res.StatusCode)
+		offset = 0
 	}
-	// TODO: Notify autoscan and/or plex
+	err = file.Truncate(int64(offset))
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(int64(offset), io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[Processor] Starting write")
+	counter.Total = offset
+	counter.Offset = offset
+	_, err = io.Copy(file, io.TeeReader(newLimitedReader(ctx, res.Body, bandwidth), counter))
 
 	return err
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestDownloadStreamResume(t *testing.T) {
+	content := testContent(3000)
+	full := func(w http.ResponseWriter, _ *http.Request) bool {
+		_, _ = w.Write(content)
+		return true
+	}
+
+	tests := []struct {
+		name            string
+		handler         func(w http.ResponseWriter, r *http.Request) bool
+		wantErr         bool
+		wantContent     []byte
+		wantTransferred uint64
+	}{
+		{"range honoured", nil, false, content, 2000},
+		{"range ignored", full, false, content, 3000},
+		{"error keeps the partial file", func(w http.ResponseWriter, _ *http.Request) bool {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		}, true, content[:1000], 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ranges []string
+			r := testPart(t, content, func(w http.ResponseWriter, req *http.Request) bool {
+				ranges = append(ranges, req.Header.Get("Range"))
+				return tt.handler != nil && tt.handler(w, req)
+			})
+
+			path := filepath.Join(mediaPath, "file.tmp")
+			if err := ioutil.WriteFile(path, content[:1000], 0644); err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			counter := testTracker(t, r)
+			err = downloadStream(context.Background(), file, r, 1000, counter)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("downloadStream() = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if len(ranges) != 1 || ranges[0] != "bytes=1000-" {
+				t.Errorf("requested ranges %v, want [bytes=1000-]", ranges)
+			}
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.wantContent) {
+				t.Errorf("file has %v bytes, want %v bytes of the part", len(got), len(tt.wantContent))
+			}
+			if got := counter.Transferred(); got != tt.wantTransferred {
+				t.Errorf("Transferred() = %v, want %v", got, tt.wantTransferred)
+			}
+		})
+	}
+}
+
+func TestDownloadMediaCompleteTemp(t *testing.T) {
+	defer func(q *DownloadQueue, p bool) { downloadQueue, probeContainer = q, p }(downloadQueue, probeContainer)
+	probeContainer = true
+
+	content := append([]byte{0x1A, 0x45, 0xDF, 0xA3}, testContent(2996)...)
+	corrupt := append([]byte("<html>"), content[6:]...)
+
+	tests := []struct {
+		name         string
+		temp         []byte
+		wantRequests int
+	}{
+		{"verified and moved into place", content, 0},
+		{"downloaded again when it fails verification", corrupt, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			requests := 0
+			r := testPart(t, content, func(http.ResponseWriter, *http.Request) bool {
+				mu.Lock()
+				defer mu.Unlock()
+
+				requests++
+				return false
+			})
+			r.Force = true
+			r.Part.Container = "mkv"
+			downloadQueue = testQueue(t)
+
+			path := downloadPath(r)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path+".tmp", tt.temp, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := downloadMedia(context.Background(), r, testTracker(t, r))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if requests != tt.wantRequests {
+				t.Errorf("%v requests to the server, want %v", requests, tt.wantRequests)
+			}
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Error("downloaded file does not match the part")
+			}
+			if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+				t.Errorf("temp file left behind: %v", err)
+			}
+		})
+	}
+}
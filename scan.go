@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oppewala/plex-local-dl/pkg/plex"
+)
+
+// scanTimeout limits how long a single scan request to plex or autoscan may take
+const scanTimeout = time.Minute
+
+// ScanNotifier asks the local Plex server and/or autoscan to pick up downloaded files. Episodes are held back until
+// the rest of their season has finished downloading, so a season is scanned once rather than for every episode.
+type ScanNotifier struct {
+	mu       sync.Mutex
+	plex     *plex.Server
+	autoscan string
+	client   *http.Client
+	mappings []PathMapping
+	maxDelay time.Duration
+	pending  map[string]*time.Timer
+}
+
+func newScanNotifier(local *plex.Server, autoscan string, client *http.Client, mappings []PathMapping, maxDelay time.Duration) *ScanNotifier {
+	return &ScanNotifier{
+		plex:     local,
+		autoscan: strings.TrimSuffix(autoscan, "/"),
+		client:   client,
+		mappings: mappings,
+		maxDelay: maxDelay,
+		pending:  make(map[string]*time.Timer),
+	}
+}
+
+// Notify records the directory of a finished download and scans it once nothing else is pending in the same season
+func (n *ScanNotifier) Notify(r DownloadRequest, path string) {
+	if n == nil {
+		return
+	}
+
+	dir := filepath.Dir(path)
+
+	n.mu.Lock()
+	if _, ok := n.pending[dir]; !ok {
+		// Scan eventually even if the rest of the season is paused or fails
+		n.pending[dir] = time.AfterFunc(n.maxDelay, func() { n.flush(dir) })
+	}
+	n.mu.Unlock()
+
+	if r.Metadata.Type == "episode" && seasonPending(r) {
+		log.Printf("[Scan] Holding scan of %v until the rest of the season has downloaded", dir)
+		return
+	}
+
+	n.flush(dir)
+}
+
+// Settle scans the directory of a request that did not download anything if an earlier download in it is waiting
+// for the season to finish
+func (n *ScanNotifier) Settle(r DownloadRequest, path string) {
+	if n == nil {
+		return
+	}
+
+	dir := filepath.Dir(path)
+
+	n.mu.Lock()
+	_, ok := n.pending[dir]
+	n.mu.Unlock()
+
+	if ok && !seasonPending(r) {
+		n.flush(dir)
+	}
+}
+
+func seasonPending(r DownloadRequest) bool {
+	for _, o := range downloadQueue.List() {
+		if o.ID == r.ID || o.Metadata.ParentRatingKey != r.Metadata.ParentRatingKey {
+			continue
+		}
+
+		switch o.State {
+		case StateQueued, StateWaitingForSpace, StateDownloading:
+			return true
+		}
+	}
+
+	return false
+}
+
+func (n *ScanNotifier) flush(dir string) {
+	n.mu.Lock()
+	t, ok := n.pending[dir]
+	if !ok {
+		n.mu.Unlock()
+		return
+	}
+	t.Stop()
+	delete(n.pending, dir)
+	n.mu.Unlock()
+
+	scanPath := filepath.ToSlash(mapPath(n.mappings, filepath.ToSlash(dir)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), scanTimeout)
+	defer cancel()
+
+	if n.plex != nil {
+		if err := n.refreshPlex(ctx, scanPath); err != nil {
+			log.Printf("[Scan] Failed to scan %v on local plex: %v", scanPath, err)
+		}
+	}
+	if n.autoscan != "" {
+		if err := n.triggerAutoscan(ctx, scanPath); err != nil {
+			log.Printf("[Scan] Failed to trigger autoscan for %v: %v", scanPath, err)
+		}
+	}
+}
+
+func (n *ScanNotifier) refreshPlex(ctx context.Context, path string) error {
+	libs, err := n.plex.GetLibraries(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, lib := range libs {
+		for _, l := range lib.Location {
+			if path != l.Path && !strings.HasPrefix(path, strings.TrimSuffix(l.Path, "/")+"/") {
+				continue
+			}
+
+			log.Printf("[Scan] Scanning %v in library %v (%v)", path, lib.Title, lib.Key)
+			return n.plex.RefreshSection(ctx, lib.Key, path)
+		}
+	}
+
+	return fmt.Errorf("no library found containing %v", path)
+}
+
+func (n *ScanNotifier) triggerAutoscan(ctx context.Context, path string) error {
+	u := fmt.Sprintf("%v/triggers/manual?dir=%v", n.autoscan, url.QueryEscape(path))
+	log.Printf("[Scan] Triggering autoscan for %v", path)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("autoscan responded with %v", res.StatusCode)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math"
@@ -36,10 +37,10 @@ func (r Results) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
 var titles = prefixmap.New()
 var media = make(map[string]plex.Metadata)
 
-func populateTitles() error {
+func populateTitles(ctx context.Context) error {
 	log.Printf("[Search] Starting library indexing")
 
-	libs, err := plexServer.GetLibraries()
+	libs, err := plexServer.GetLibraries(ctx)
 	if err != nil {
 		err = fmt.Errorf("failed to retrieve libraries\n %v", err)
 		return err
@@ -49,7 +50,7 @@ func populateTitles() error {
 
 	for _, lib := range libs {
 		log.Printf("[Search][%s (%v)] Retrieving library contents ", lib.Title, lib.Key)
-		lc, err := plexServer.GetLibraryContent(lib.Key)
+		lc, err := plexServer.GetLibraryContent(ctx, lib.Key)
 		if err != nil {
 			err = fmt.Errorf("failed to retrieve library content ([%v] %s)\n%v", lib.Key, lib.Title, err)
 		}
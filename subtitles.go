@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/oppewala/plex-local-dl/pkg/plex"
+)
+
+// downloadSubtitles fetches the external subtitle files of the part and saves them next to the video, named
+// <video>.<language>[.forced].<codec> so the local plex server matches them up. Existing files are left alone.
+func downloadSubtitles(ctx context.Context, r DownloadRequest, videoPath string) error {
+	streams, err := subtitleStreams(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	base := strings.TrimSuffix(videoPath, filepath.Ext(videoPath))
+	used := make(map[string]bool)
+	for _, st := range streams {
+		path := subtitlePath(base, st, used)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+
+		log.Printf("[Processor] Downloading %v subtitles for %v to %v", st.DisplayTitle, r.Title(), path)
+		err := downloadFile(ctx, st.Key, path)
+		if err != nil {
+			err = fmt.Errorf("failed to download subtitles %v: %w", st.Key, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// subtitleStreams looks up the streams of the part, child listings of shows and seasons don't include them so the
+// item is requested again when they're missing
+func subtitleStreams(ctx context.Context, r DownloadRequest) ([]plex.Stream, error) {
+	if len(r.Part.Stream) > 0 {
+		return r.Part.ExternalSubtitles(), nil
+	}
+
+	m, err := plexServer.GetMediaMetadata(ctx, r.Metadata.RatingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, media := range m.Media {
+		for _, p := range media.Part {
+			if p.ID == r.Part.ID {
+				return p.ExternalSubtitles(), nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func subtitlePath(base string, st plex.Stream, used map[string]bool) string {
+	lang := st.LanguageTag
+	if lang == "" {
+		lang = st.LanguageCode
+	}
+	if lang == "" {
+		lang = "und"
+	}
+
+	name := base + "." + lang
+	if st.Forced {
+		name += ".forced"
+	}
+
+	ext := st.Codec
+	if ext == "" {
+		ext = st.Format
+	}
+	if ext == "" {
+		ext = "srt"
+	}
+
+	// Several files in the same language are numbered so they don't overwrite each other
+	path := name + "." + ext
+	for i := 2; used[path]; i++ {
+		path = fmt.Sprintf("%v.%v.%v", name, i, ext)
+	}
+	used[path] = true
+
+	return path
+}
+
+// downloadFile saves a small file from the remote server in one go
+func downloadFile(ctx context.Context, key string, path string) error {
+	req, err := partRequest(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	res, err := plexClient.Do(req)
+	if err != nil {
+		return plex.NewRequestError(key, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return plex.NewStatusError(key, res.StatusCode)
+	}
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, res.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path + ".tmp")
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oppewala/plex-local-dl/pkg/plex"
+)
+
+// transcodeStopTimeout limits how long stopping a transcode session can hold up the worker
+const transcodeStopTimeout = time.Second * 10
+
+// TranscodeProfile asks the remote server to convert the part to an mp4 of the given resolution and bitrate (kbps)
+// instead of sending the original file
+type TranscodeProfile struct {
+	Name       string
+	Resolution string
+	Bitrate    int
+}
+
+var transcodeProfiles = map[string]TranscodeProfile{
+	"1080p": {Name: "1080p", Resolution: "1920x1080", Bitrate: 8000},
+	"720p":  {Name: "720p", Resolution: "1280x720", Bitrate: 4000},
+	"480p":  {Name: "480p", Resolution: "720x480", Bitrate: 1500},
+}
+
+// parseTranscodeProfile looks up a named profile, optionally overriding its bitrate
+func parseTranscodeProfile(name string, bitrate string) (*TranscodeProfile, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	p, ok := transcodeProfiles[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown transcode profile '%v', expected 1080p, 720p or 480p", name)
+	}
+
+	if bitrate != "" {
+		b, err := strconv.Atoi(bitrate)
+		if err != nil || b <= 0 {
+			return nil, fmt.Errorf("invalid transcode bitrate '%v'", bitrate)
+		}
+		p.Bitrate = b
+	}
+
+	return &p, nil
+}
+
+// equal is true when both are nil or ask for the same output
+func (p *TranscodeProfile) equal(o *TranscodeProfile) bool {
+	if p == nil || o == nil {
+		return p == o
+	}
+
+	return *p == *o
+}
+
+// transcodeRequest creates a request for the part from the universal transcoder of the remote server
+func transcodeRequest(ctx context.Context, r DownloadRequest) (*http.Request, error) {
+	mediaIndex := 0
+	for i, m := range r.Metadata.Media {
+		if m.ID == r.MediaID {
+			mediaIndex = i
+		}
+	}
+
+	q := url.Values{}
+	q.Set("path", "/library/metadata/"+r.Metadata.RatingKey)
+	q.Set("mediaIndex", strconv.Itoa(mediaIndex))
+	q.Set("partIndex", strconv.Itoa(r.PartIndex))
+	q.Set("protocol", "http")
+	q.Set("offset", "0")
+	q.Set("fastSeek", "1")
+	q.Set("directPlay", "0")
+	q.Set("directStream", "1")
+	q.Set("directStreamAudio", "1")
+	q.Set("videoQuality", "100")
+	q.Set("videoResolution", r.Transcode.Resolution)
+	q.Set("maxVideoBitrate", strconv.Itoa(r.Transcode.Bitrate))
+	q.Set("session", r.ID)
+	q.Set("X-Plex-Session-Identifier", r.ID)
+	q.Set("X-Plex-Client-Identifier", "plex-local-dl")
+	q.Set("X-Plex-Product", "Plex Local DL")
+	q.Set("X-Plex-Platform", "Generic")
+	q.Set("X-Plex-Token", plexToken)
+
+	u := fmt.Sprintf("%v/video/:/transcode/universal/start.mp4?%v", plexUrl, q.Encode())
+	return http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+}
+
+// stopTranscode ends the transcode session of a request that stopped before the whole file was received, otherwise
+// the remote server keeps transcoding for a client that is gone
+func stopTranscode(r DownloadRequest) {
+	// The download's own context is usually cancelled by now
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeStopTimeout)
+	defer cancel()
+
+	q := url.Values{}
+	q.Set("session", r.ID)
+	q.Set("X-Plex-Client-Identifier", "plex-local-dl")
+	q.Set("X-Plex-Token", plexToken)
+
+	path := "/video/:/transcode/universal/stop"
+	u := fmt.Sprintf("%v%v?%v", plexUrl, path, q.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		log.Printf("[Processor] Failed to stop transcode of %v: %v", r.Title(), err)
+		return
+	}
+
+	res, err := plexClient.Do(req)
+	if err != nil {
+		log.Printf("[Processor] Failed to stop transcode of %v: %v", r.Title(), plex.NewRequestError(path, err))
+		return
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		log.Printf("[Processor] Failed to stop transcode of %v: %v", r.Title(), plex.NewStatusError(path, res.StatusCode))
+		return
+	}
+	log.Printf("[Processor] Stopped transcode session of %v", r.Title())
+}
+
+// expectedSize is the size of the file the request will produce, transcodes are estimated from the bitrate
+func expectedSize(r DownloadRequest) uint64 {
+	if r.Transcode == nil {
+		return r.Part.Size
+	}
+
+	return uint64(r.Transcode.Bitrate) * 1000 / 8 * uint64(r.Part.Duration) / 1000
+}
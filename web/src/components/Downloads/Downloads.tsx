@@ -1,21 +1,60 @@
-import React, {useContext, useMemo, useState} from "react";
+import React, {useContext, useEffect, useMemo, useState} from "react";
 import SocketContext, {Message} from "@components/SocketContext/SocketContext";
+import {History as HistoryApi} from "@services/Api/Api.service";
+import {HistoryEntry, HistoryFilter} from "@services/Api/types";
 
 interface DownloadUpdateMessage extends Message {
+    ID: string
+    RatingKey: string
+    Worker: number
     Title: string
     BytesDownloaded: number
     TotalBytes: number
+    Speed?: number
+    ETA?: number
+    QueuePosition?: number
+}
+
+interface DownloadStateMessage extends Message {
+    ID: string
+    Title: string
+    State: string
+    Attempts: number
+    NextAttempt: string
+    Error: string
+}
+
+interface WorkerUpdateMessage extends Message {
+    Worker: number
+    State: string
+    Title: string
+}
+
+type Worker = {
+    Worker: number
+    State: string
+    Title: string
 }
 
 type Download = {
+    ID: string
+    RatingKey: string
+    State: string
+    Worker: number
     Title: string
     BytesDownloaded: number
     TotalBytes: number
     Complete: boolean
+    Error?: string
+    NextAttempt?: string
+    Speed?: number
+    ETA?: number
+    QueuePosition?: number
 }
 
 export const Downloads = () => {
     const [downloads, setDownloads] = useState<{ [title: string]: Download }>({})
+    const [workers, setWorkers] = useState<{ [worker: number]: Worker }>({})
 
     const socketContext = useContext(SocketContext);
 
@@ -28,10 +67,16 @@ export const Downloads = () => {
                 ...prevState
             };
             newState[msg.Title] = {
+                ID: msg.ID,
+                RatingKey: msg.RatingKey,
+                State: 'downloading',
+                Worker: msg.Worker,
                 Title: msg.Title,
                 BytesDownloaded: msg.BytesDownloaded,
                 TotalBytes: msg.TotalBytes,
-                Complete: false
+                Complete: false,
+                Speed: msg.Speed,
+                ETA: msg.ETA
             };
             console.log('setting state', msg, msg.Title, prevState, newState)
             return newState;
@@ -45,6 +90,10 @@ export const Downloads = () => {
                 ...prevState
             };
             newState[msg.Title] = {
+                ID: msg.ID,
+                RatingKey: msg.RatingKey,
+                State: msg.MessageType === 'download-skipped' ? 'skipped' : 'done',
+                Worker: msg.Worker,
                 Title: msg.Title,
                 BytesDownloaded: 100,
                 TotalBytes: 100,
@@ -61,10 +110,55 @@ export const Downloads = () => {
                 ...prevState
             };
             newState[msg.Title] = {
+                ID: msg.ID,
+                RatingKey: msg.RatingKey,
+                State: 'queued',
+                Worker: msg.Worker,
                 Title: msg.Title,
                 BytesDownloaded: msg.BytesDownloaded,
                 TotalBytes: msg.TotalBytes,
-                Complete: false
+                Complete: false,
+                QueuePosition: msg.QueuePosition
+            };
+            return newState;
+        });
+    }
+
+    const handleStateMessage = (message: Message) => {
+        const msg = message as DownloadStateMessage;
+        setDownloads((prevState: { [title: string]: Download }) => {
+            const prev = prevState[msg.Title];
+            if (prev === undefined) return prevState;
+
+            let newState = {
+                ...prevState
+            };
+            newState[msg.Title] = {
+                ...prev,
+                ID: msg.ID,
+                State: msg.State,
+                Complete: msg.State === 'done',
+                Error: msg.Error,
+                NextAttempt: msg.Attempts > 0 && msg.State === 'queued' ? msg.NextAttempt : undefined
+            };
+            return newState;
+        });
+    }
+
+    const sendCommand = (command: string, id: string) => {
+        socketContext.Connection.send(JSON.stringify({Command: command, ID: id}))
+    }
+
+    const handleWorkerMessage = (message: Message) => {
+        const msg = message as WorkerUpdateMessage;
+        setWorkers((prevState: { [worker: number]: Worker }) => {
+            let newState = {
+                ...prevState
+            };
+            newState[msg.Worker] = {
+                Worker: msg.Worker,
+                State: msg.State,
+                Title: msg.Title
             };
             return newState;
         });
@@ -96,17 +190,122 @@ export const Downloads = () => {
             MessageType: 'download-complete',
             Emit: handleCompleteMessage
         })
+        socketContext.AddListener({
+            MessageType: 'download-skipped',
+            Emit: handleCompleteMessage
+        })
+        socketContext.AddListener({
+            MessageType: 'download-state',
+            Emit: handleStateMessage
+        })
+        socketContext.AddListener({
+            MessageType: 'worker-update',
+            Emit: handleWorkerMessage
+        })
     }, [socketContext])
 
     return (
         <div className='w-full'>
+            <WorkerSummary workers={workers}/>
             <ul className='w-full'>{Object.getOwnPropertyNames(downloads).map((t) => <DownloadBar key={t} title={t}
-                                                                                                  downloads={downloads}/>)}</ul>
+                                                                                                  downloads={downloads}
+                                                                                                  onCommand={sendCommand}/>)}</ul>
+            <DownloadHistory/>
         </div>
     )
 }
 
-const DownloadBar: React.FC<{ title: string, downloads: { [title: string]: Download } }> = ({title, downloads}) => {
+const formatBytes = (b: number): string => {
+    const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+    let i = 0;
+    while (b >= 1024 && i < units.length - 1) {
+        b /= 1024;
+        i++;
+    }
+    return `${Math.round(b * 10) / 10} ${units[i]}`
+}
+
+const formatDuration = (seconds: number): string => {
+    const h = Math.floor(seconds / 3600);
+    const m = Math.floor(seconds % 3600 / 60);
+    const s = Math.floor(seconds % 60);
+    if (h > 0) return `${h}h ${m}m`;
+    if (m > 0) return `${m}m ${s}s`;
+    return `${s}s`
+}
+
+const DownloadHistory = () => {
+    const [filter, setFilter] = useState<HistoryFilter>({})
+    const [entries, setEntries] = useState<Array<HistoryEntry>>([])
+    const [refresh, setRefresh] = useState(0)
+
+    useEffect(() => {
+        const controller = new AbortController();
+        HistoryApi(filter, {signal: controller.signal})
+            .then(setEntries)
+            .catch(e => console.log('failed to load history', e))
+        return () => controller.abort();
+    }, [filter, refresh])
+
+    const update = (key: keyof HistoryFilter) => (e: React.ChangeEvent<HTMLInputElement | HTMLSelectElement>) =>
+        setFilter(prev => ({...prev, [key]: e.target.value}))
+
+    return (
+        <div className='w-full my-6'>
+            <div className='flex justify-between items-center'>
+                <h2 className='text-lg'>History</h2>
+                <div className='space-x-2 text-sm'>
+                    <input type='date' value={filter.from ?? ''} onChange={update('from')}/>
+                    <input type='date' value={filter.to ?? ''} onChange={update('to')}/>
+                    <select value={filter.type ?? ''} onChange={update('type')}>
+                        <option value=''>All types</option>
+                        <option value='movie'>Movies</option>
+                        <option value='episode'>Episodes</option>
+                    </select>
+                    <select value={filter.status ?? ''} onChange={update('status')}>
+                        <option value=''>All statuses</option>
+                        <option value='done'>Done</option>
+                        <option value='failed'>Failed</option>
+                        <option value='cancelled'>Cancelled</option>
+                    </select>
+                    <button className='underline' onClick={() => setRefresh(r => r + 1)}>refresh</button>
+                </div>
+            </div>
+            <table className='w-full text-sm text-left'>
+                <thead>
+                <tr>
+                    <th>Finished</th>
+                    <th>Title</th>
+                    <th>Status</th>
+                    <th>Size</th>
+                    <th>Speed</th>
+                </tr>
+                </thead>
+                <tbody>
+                {entries.map(e => <tr key={e.ID + e.FinishedAt} title={e.Error ?? e.Path}>
+                    <td>{new Date(e.FinishedAt).toLocaleString()}</td>
+                    <td>{e.Title}</td>
+                    <td className={e.Status === 'failed' ? 'text-red-700' : ''}>{e.Status}</td>
+                    <td>{formatBytes(e.Bytes)}</td>
+                    <td>{e.AverageSpeed > 0 ? `${formatBytes(e.AverageSpeed)}/s` : ''}</td>
+                </tr>)}
+                </tbody>
+            </table>
+        </div>
+    )
+}
+
+const WorkerSummary: React.FC<{ workers: { [worker: number]: Worker } }> = ({workers}) => {
+    const all = Object.values(workers);
+    if (all.length === 0) return null;
+
+    const active = all.filter(w => w.State === 'downloading').length;
+    return (
+        <div className='text-sm text-gray-600'>{active} of {all.length} workers downloading</div>
+    )
+}
+
+const DownloadBar: React.FC<{ title: string, downloads: { [title: string]: Download }, onCommand: (command: string, id: string) => void }> = ({title, downloads, onCommand}) => {
     const download = downloads[title];
 
     const percentNumber = (dl: Download): number => {
@@ -134,8 +333,45 @@ const DownloadBar: React.FC<{ title: string, downloads: { [title: string]: Downl
                   className={`-z-10 absolute inset-0 h-full bg-none border-solid border-r border-green-600 ${animateStyle}`}
                   style={progressStyle} />}
             </div>
-            <div className=''>{title} {perc === 0 ? '(queued)' : `(${perc}%)`}</div>
+            <div className='flex justify-between'>
+                <div>
+                    {download.Worker > 0 && `[${download.Worker}] `}{title} {perc === 0 ? `(${download.State})` : `(${perc}%)`}
+                    {download.State === 'queued' && download.QueuePosition && <span className='text-sm text-gray-600'> #{download.QueuePosition} in queue</span>}
+                    {download.State === 'downloading' && download.Speed && <span className='text-sm text-gray-600'>
+                        {' '}{formatBytes(download.Speed)}/s{download.ETA ? `, ${formatDuration(download.ETA)} left` : ''}
+                    </span>}
+                </div>
+                <DownloadControls download={download} onCommand={onCommand}/>
+            </div>
+            {download.Error && download.State === 'failed' && <div className='text-sm text-red-700'>Failed: {download.Error}</div>}
+            {download.Error && download.State === 'waiting-for-space' && <div className='text-sm text-gray-600'>Waiting for space: {download.Error}</div>}
+            {download.Error && download.NextAttempt && <div className='text-sm text-gray-600'>
+                Retrying at {new Date(download.NextAttempt).toLocaleTimeString()} ({download.Error})
+            </div>}
         </li>)
 }
 
+const DownloadControls: React.FC<{ download: Download, onCommand: (command: string, id: string) => void }> = ({download, onCommand}) => {
+    const commands: Array<string> = [];
+    switch (download.State) {
+        case 'queued':
+        case 'waiting-for-space':
+        case 'downloading':
+            commands.push('pause', 'cancel');
+            break;
+        case 'paused':
+            commands.push('resume', 'cancel');
+            break;
+        case 'failed':
+            commands.push('retry', 'cancel');
+            break;
+    }
+
+    return (
+        <div className='space-x-2'>
+            {commands.map(c => <button key={c} className='text-sm underline'
+                                       onClick={() => onCommand(c, download.ID)}>{c}</button>)}
+        </div>)
+}
+
 export default Downloads;
\ No newline at end of file
@@ -1,5 +1,11 @@
 import {Config} from "@utils/Config/config";
-import {DownloadPersistResponse, DownloadResponse, SearchResponse} from "@services/Api/types";
+import {
+    DownloadPersistResponse,
+    DownloadResponse,
+    HistoryEntry,
+    HistoryFilter,
+    SearchResponse
+} from "@services/Api/types";
 
 const Search = async (query: string, options?: RequestInit): Promise<Array<SearchResponse>> => {
     const url = new URL('/api/search', Config.ApiRoot)
@@ -37,4 +43,18 @@ const DownloadPersist = async (key: string, options?: RequestInit): Promise<Down
     return await res.json()
 }
 
-export { Search, Download, DownloadPersist };
\ No newline at end of file
+const History = async (filter: HistoryFilter, options?: RequestInit): Promise<Array<HistoryEntry>> => {
+    const url = new URL('/api/history', Config.ApiRoot)
+    const opt: RequestInit = {
+        ...options,
+        method: 'GET',
+    };
+    Object.entries(filter).forEach(([k, v]) => {
+        if (v) url.searchParams.append(k, v);
+    });
+
+    const res = await fetch(url.toString(), opt);
+    return await res.json()
+}
+
+export { Search, Download, DownloadPersist, History };
\ No newline at end of file
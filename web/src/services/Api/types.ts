@@ -14,4 +14,27 @@ export type DownloadResponse = {
 
 export type DownloadPersistResponse = {
     Message: string
+}
+
+export type HistoryEntry = {
+    ID: string;
+    RatingKey: string;
+    Type: string;
+    Title: string;
+    Status: string;
+    Bytes: number;
+    Duration: number;
+    AverageSpeed: number;
+    PartKey: string;
+    Path: string;
+    Error?: string;
+    StartedAt: string;
+    FinishedAt: string;
+}
+
+export type HistoryFilter = {
+    from?: string;
+    to?: string;
+    type?: string;
+    status?: string;
 }
\ No newline at end of file
@@ -91,7 +91,8 @@ type SonarrWebhook struct {
 	EventType      string `json:"eventType"`
 }
 
-func newQueueConsumer(connString string) {
+// newQueueConsumer starts handling the *arr webhooks forwarded through the azure queue until ctx is cancelled
+func newQueueConsumer(ctx context.Context, connString string) {
 	r := regexp.MustCompile("DefaultEndpointsProtocol=(?P<protocol>[^;]+);AccountName=(?P<accountName>[^;]+);AccountKey=(?P<accountKey>[^;]+);EndpointSuffix=(?P<endpoingSuffix>[a-z0-9.]+)")
 	m := r.FindStringSubmatch(connString)
 	saProtocol, saAccount, saKey, saSuffix := m[1], m[2], m[3], m[4]
@@ -118,8 +119,11 @@ func newQueueConsumer(connString string) {
 
 	go func(q *azqueue.MessagesURL) {
 		fails := 0
-		for {
-			r, err := q.Dequeue(context.TODO(), 5, time.Second*30)
+		for ctx.Err() == nil {
+			r, err := q.Dequeue(ctx, 5, time.Second*30)
+			if ctx.Err() != nil {
+				break
+			}
 			if err != nil {
 				d := time.Minute * 2
 				if fails > 3 {
@@ -128,7 +132,10 @@ func newQueueConsumer(connString string) {
 
 				fails++
 				log.Printf("[Arr] Failed to dequeue message. Pausing for %v. (Fail %v): %v", d, fails, err)
-				time.Sleep(d)
+				select {
+				case <-ctx.Done():
+				case <-time.After(d):
+				}
 
 				continue
 			}
@@ -136,7 +143,7 @@ func newQueueConsumer(connString string) {
 			for i := int32(0); i < r.NumMessages(); i++ {
 				m := r.Message(i)
 
-				err = handleMessage(m.Text)
+				err = handleMessage(ctx, m.Text)
 				if err != nil {
 					log.Printf("[Arr] Failed to handle message: %v\n%v", err, m.Text)
 
@@ -145,13 +152,14 @@ func newQueueConsumer(connString string) {
 				}
 
 				murl := q.NewMessageIDURL(m.ID)
-				_, _ = murl.Delete(context.TODO(), m.PopReceipt)
+				_, _ = murl.Delete(ctx, m.PopReceipt)
 			}
 		}
+		log.Printf("[Arr] Stopped consuming azure queue")
 	}(&q)
 }
 
-func handleMessage(msg string) error {
+func handleMessage(ctx context.Context, msg string) error {
 	var dat map[string]interface{}
 	if err := json.Unmarshal([]byte(msg), &dat); err != nil {
 		err = fmt.Errorf("could not unmarshal dequeued message: %w", err)
@@ -164,7 +172,7 @@ func handleMessage(msg string) error {
 			err = fmt.Errorf("failed to parse 'movie' as object: %w", err)
 			return err
 		}
-		if err := handleMovie(wh); err != nil {
+		if err := handleMovie(ctx, wh); err != nil {
 			err = fmt.Errorf("failed to handle movie message %w", err)
 			return err
 		}
@@ -177,7 +185,7 @@ func handleMessage(msg string) error {
 			err = fmt.Errorf("failed to parse 'series' as object %w", err)
 			return err
 		}
-		if err := handleSeries(wh); err != nil {
+		if err := handleSeries(ctx, wh); err != nil {
 			err = fmt.Errorf("failed to handle series message: %w", err)
 			return err
 		}
@@ -187,7 +195,7 @@ func handleMessage(msg string) error {
 	return errors.New(fmt.Sprintf("could not handle message: %v", msg))
 }
 
-func handleMovie(wh RadarrWebhook) error {
+func handleMovie(ctx context.Context, wh RadarrWebhook) error {
 	log.Printf("[Arr] Movie webhook message received (%s - %s)", wh.Movie.ImdbID, wh.Movie.Title)
 
 	exists, err := store.Exists("movie", wh.Movie.ImdbID)
@@ -203,20 +211,17 @@ func handleMovie(wh RadarrWebhook) error {
 	e, err := store.Get("movie", wh.Movie.ImdbID)
 	k := strconv.FormatUint(uint64(e.PlexKey), 10)
 
-	parts, err := plexServer.GetMetadataWithParts(k)
+	parts, err := plexServer.GetMetadataWithParts(ctx, k)
 	if err != nil {
 		err = fmt.Errorf("failed to get metadata (%s - %s - %s): %w", k, wh.Movie.ImdbID, wh.Movie.Title, err)
 		return err
 	}
 
-	for _, p := range parts {
-		queueDownload(p)
-	}
-
-	return nil
+	_, err = queueDownloads(parts, DownloadOptions{Quality: e.Quality})
+	return err
 }
 
-func handleSeries(wh SonarrWebhook) error {
+func handleSeries(ctx context.Context, wh SonarrWebhook) error {
 	log.Printf("[Arr] Series webhook message received (%v - %s)", wh.Series.TvdbID, wh.Series.Title)
 
 	id := strconv.FormatInt(int64(wh.Series.TvdbID), 10)
@@ -234,15 +239,12 @@ func handleSeries(wh SonarrWebhook) error {
 	k := strconv.FormatUint(uint64(e.PlexKey), 10)
 
 	// TODO: This currently downloads all episodes again, instead of only queuing the new episodes
-	meta, err := plexServer.GetMetadataWithParts(k)
+	meta, err := plexServer.GetMetadataWithParts(ctx, k)
 	if err != nil {
 		err = fmt.Errorf("failed to get metadata (%s - %s - %s): %w", k, wh.Series.ImdbID, wh.Series.Title, err)
 		return err
 	}
 
-	for _, p := range meta {
-		queueDownload(p)
-	}
-
-	return nil
+	_, err = queueDownloads(meta, DownloadOptions{Quality: e.Quality})
+	return err
 }
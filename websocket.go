@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
 	"time"
@@ -126,11 +127,16 @@ func (c *Client) readPump() {
 			}
 			break
 		}
-		log.Printf("[WS] Message received: %v", message)
+		log.Printf("[WS] Message received: %s", message)
 
-		// TODO: Handle incoming cancel message
-		// message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		//c.hub.broadcast <- message
+		var cmd ClientCommand
+		if err := json.Unmarshal(message, &cmd); err != nil {
+			log.Printf("[WS] Could not parse command: %v", err)
+			continue
+		}
+		if err := handleCommand(cmd); err != nil {
+			log.Printf("[WS] Failed to handle %v command for %v: %v", cmd.Command, cmd.ID, err)
+		}
 	}
 }
 